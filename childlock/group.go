@@ -0,0 +1,83 @@
+package childlock
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+//
+// Create a new group based on the supplied values
+// name:    of the group
+// member:  unique identifier of this process within group
+// ttl:     duration in seconds, after which a member not seen is dropped
+//
+func (this *LockManager) NewGroup(name string, member string, ttl int) *Group {
+	return &Group{
+		name:    name,
+		member:  member,
+		ttl:     time.Duration(ttl) * time.Second,
+		manager: this,
+	}
+}
+
+//
+// Group tracks the live members sharing a resource.
+// Members are kept in a sorted set, scored by the time till which they are
+// considered alive. Members need to Join at regular intervals to stay alive.
+//
+type Group struct {
+	name    string
+	member  string
+	ttl     time.Duration
+	manager *LockManager
+}
+
+//
+// Get identifier of this member.
+//
+func (this *Group) GetMember() string {
+	return this.member
+}
+
+//
+// Join group or, if already joined, extend membership.
+//
+func (this *Group) Join() error {
+	now := time.Now()
+	_, err := this.manager.GetClient().TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(this.name, redis.Z{
+			Score:  float64(now.Add(this.ttl).UnixNano()),
+			Member: this.member,
+		})
+		//drop members that went away.
+		pipe.ZRemRangeByScore(this.name, "-inf", "("+strconv.FormatInt(now.UnixNano(), 10))
+		pipe.Expire(this.name, this.ttl)
+		return nil
+	})
+	return err
+}
+
+//
+// Leave group.
+//
+func (this *Group) Leave() error {
+	return this.manager.GetClient().ZRem(this.name, this.member).Err()
+}
+
+//
+// Get all the live members of group, sorted by their identifiers.
+//
+func (this *Group) Members() ([]string, error) {
+	members, err := this.manager.GetClient().ZRangeByScore(this.name, redis.ZRangeBy{
+		Min: strconv.FormatInt(time.Now().UnixNano(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	sort.Strings(members)
+	return members, nil
+}
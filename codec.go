@@ -0,0 +1,417 @@
+package raven
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var _ Codec = (*JsonCodec)(nil)
+var _ Codec = (*MsgpackCodec)(nil)
+var _ Codec = (*ProtobufCodec)(nil)
+
+//
+// Codec defines how a message is encoded before handing it over to
+// Raven Manager and decoded after receiving.
+//
+// All processes sharing a queue need to use the same codec. While switching
+// codecs, entries written earlier using JSON are still decoded.
+//
+type Codec interface {
+	//Name of the codec.
+	Name() string
+
+	Encode(m *Message) ([]byte, error)
+
+	Decode(data []byte, m *Message) error
+}
+
+// Codec used when none is specified.
+var DefaultCodec Codec = JsonCodec{}
+
+//
+// Encodes message as JSON, the default and backward compatible codec.
+//
+type JsonCodec struct{}
+
+func (this JsonCodec) Name() string {
+	return "json"
+}
+
+func (this JsonCodec) Encode(m *Message) ([]byte, error) {
+	return json.Marshal(m)
+}
+
+func (this JsonCodec) Decode(data []byte, m *Message) error {
+	return json.Unmarshal(data, m)
+}
+
+//
+// Encodes message as MessagePack, compact and cheaper to encode than JSON.
+//
+type MsgpackCodec struct{}
+
+func (this MsgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (this MsgpackCodec) Encode(m *Message) ([]byte, error) {
+	return msgpack.Marshal(m)
+}
+
+func (this MsgpackCodec) Decode(data []byte, m *Message) error {
+	return msgpack.Unmarshal(data, m)
+}
+
+//
+// Encodes message as a protobuf envelope, following is its schema.
+// Unknown fields are skipped while decoding, so fields can be added later on.
+//
+//	message Envelope {
+//	  string id = 1;
+//	  string type = 2;
+//	  bytes data = 3;
+//	  string shard_key = 4;
+//	  map<string, string> headers = 5;
+//	  bytes payload = 6;
+//	  int32 attempts = 7;
+//	  int64 sent_at = 8;      //unix nano
+//	  int64 enqueued_at = 9;  //unix nano
+//	  Failure failure = 10;
+//	}
+//
+//	message Failure {
+//	  string last_error = 1;
+//	  repeated AttemptError errors = 2;
+//	  int32 attempts = 3;
+//	  string receiver = 4;
+//	  string box = 5;
+//	  int64 failed_at = 6;    //unix nano
+//	}
+//
+//	message AttemptError {
+//	  int32 attempt = 1;
+//	  string error = 2;
+//	  int64 at = 3;           //unix nano
+//	}
+//
+type ProtobufCodec struct{}
+
+//
+// Field numbers of protobuf envelope.
+//
+const (
+	pbFieldId       protowire.Number = 1
+	pbFieldType     protowire.Number = 2
+	pbFieldData     protowire.Number = 3
+	pbFieldShardKey protowire.Number = 4
+	pbFieldHeaders  protowire.Number = 5
+	pbFieldPayload  protowire.Number = 6
+	pbFieldAttempts protowire.Number = 7
+	pbFieldSentAt   protowire.Number = 8
+	pbFieldEnqueued protowire.Number = 9
+	pbFieldFailure  protowire.Number = 10
+
+	//fields of failure.
+	pbFieldLastError protowire.Number = 1
+	pbFieldErrors    protowire.Number = 2
+	pbFieldFAttempts protowire.Number = 3
+	pbFieldReceiver  protowire.Number = 4
+	pbFieldBox       protowire.Number = 5
+	pbFieldFailedAt  protowire.Number = 6
+
+	//fields of attempt error.
+	pbFieldAttempt protowire.Number = 1
+	pbFieldError   protowire.Number = 2
+	pbFieldAt      protowire.Number = 3
+
+	//fields of map entry.
+	pbFieldKey   protowire.Number = 1
+	pbFieldValue protowire.Number = 2
+)
+
+func (this ProtobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (this ProtobufCodec) Encode(m *Message) ([]byte, error) {
+	var b []byte
+	b = pbAppendString(b, pbFieldId, m.Id)
+	b = pbAppendString(b, pbFieldType, m.Type)
+	b = pbAppendString(b, pbFieldData, m.Data)
+	b = pbAppendString(b, pbFieldShardKey, m.ShardKey)
+	for k, v := range m.Headers {
+		var entry []byte
+		entry = pbAppendString(entry, pbFieldKey, k)
+		entry = pbAppendString(entry, pbFieldValue, v)
+		b = protowire.AppendTag(b, pbFieldHeaders, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	if len(m.Payload) > 0 {
+		b = protowire.AppendTag(b, pbFieldPayload, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.Payload)
+	}
+	b = pbAppendInt(b, pbFieldAttempts, m.Attempts)
+	b = pbAppendTime(b, pbFieldSentAt, m.SentAt)
+	b = pbAppendTime(b, pbFieldEnqueued, m.EnqueuedAt)
+	if m.Failure != nil {
+		b = protowire.AppendTag(b, pbFieldFailure, protowire.BytesType)
+		b = protowire.AppendBytes(b, pbEncodeFailure(m.Failure))
+	}
+	return b, nil
+}
+
+func (this ProtobufCodec) Decode(data []byte, m *Message) error {
+	return pbRange(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if typ == protowire.VarintType {
+			v, _ := protowire.ConsumeVarint(value)
+			switch num {
+			case pbFieldAttempts:
+				m.Attempts = int(v)
+			case pbFieldSentAt:
+				m.SentAt = time.Unix(0, int64(v))
+			case pbFieldEnqueued:
+				m.EnqueuedAt = time.Unix(0, int64(v))
+			}
+			return nil
+		}
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case pbFieldId:
+			m.Id = string(value)
+		case pbFieldType:
+			m.Type = string(value)
+		case pbFieldData:
+			m.Data = string(value)
+		case pbFieldShardKey:
+			m.ShardKey = string(value)
+		case pbFieldHeaders:
+			var k, v string
+			err := pbRange(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				switch num {
+				case pbFieldKey:
+					k = string(value)
+				case pbFieldValue:
+					v = string(value)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			m.SetHeader(k, v)
+		case pbFieldPayload:
+			m.Payload = append([]byte(nil), value...)
+		case pbFieldFailure:
+			m.Failure = new(Failure)
+			return pbDecodeFailure(value, m.Failure)
+		}
+		return nil
+	})
+}
+
+func pbEncodeFailure(f *Failure) []byte {
+	var b []byte
+	b = pbAppendString(b, pbFieldLastError, f.LastError)
+	for _, e := range f.Errors {
+		var entry []byte
+		entry = pbAppendInt(entry, pbFieldAttempt, e.Attempt)
+		entry = pbAppendString(entry, pbFieldError, e.Error)
+		entry = pbAppendTime(entry, pbFieldAt, e.At)
+		b = protowire.AppendTag(b, pbFieldErrors, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	b = pbAppendInt(b, pbFieldFAttempts, f.Attempts)
+	b = pbAppendString(b, pbFieldReceiver, f.Receiver)
+	b = pbAppendString(b, pbFieldBox, f.Box)
+	b = pbAppendTime(b, pbFieldFailedAt, f.FailedAt)
+	return b
+}
+
+func pbDecodeFailure(data []byte, f *Failure) error {
+	return pbRange(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if typ == protowire.VarintType {
+			v, _ := protowire.ConsumeVarint(value)
+			switch num {
+			case pbFieldFAttempts:
+				f.Attempts = int(v)
+			case pbFieldFailedAt:
+				f.FailedAt = time.Unix(0, int64(v))
+			}
+			return nil
+		}
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case pbFieldLastError:
+			f.LastError = string(value)
+		case pbFieldReceiver:
+			f.Receiver = string(value)
+		case pbFieldBox:
+			f.Box = string(value)
+		case pbFieldErrors:
+			var e AttemptError
+			err := pbRange(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				switch {
+				case num == pbFieldError && typ == protowire.BytesType:
+					e.Error = string(value)
+				case typ == protowire.VarintType:
+					v, _ := protowire.ConsumeVarint(value)
+					if num == pbFieldAttempt {
+						e.Attempt = int(v)
+					} else if num == pbFieldAt {
+						e.At = time.Unix(0, int64(v))
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			f.Errors = append(f.Errors, e)
+		}
+		return nil
+	})
+}
+
+func pbAppendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func pbAppendInt(b []byte, num protowire.Number, v int) []byte {
+	if v <= 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+func pbAppendTime(b []byte, num protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(t.UnixNano()))
+}
+
+// iterate over fields of an encoded protobuf message.
+// value holds content of length delimited fields and encoded value of others.
+func pbRange(b []byte, f func(protowire.Number, protowire.Type, []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var value []byte
+		if typ == protowire.BytesType {
+			value, n = protowire.ConsumeBytes(b)
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n >= 0 {
+				value = b[:n]
+			}
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := f(num, typ, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// Implemented by managers that encode messages using a pluggable codec.
+//
+type CodecAware interface {
+	SetCodec(c Codec)
+}
+
+//
+// Embedded by managers, to encode and decode messages using farm's codec.
+//
+type codecHolder struct {
+	codec Codec
+}
+
+func (this *codecHolder) SetCodec(c Codec) {
+	this.codec = c
+}
+
+func (this *codecHolder) getCodec() Codec {
+	if this.codec == nil {
+		return DefaultCodec
+	}
+	return this.codec
+}
+
+func (this *codecHolder) encode(m *Message) (string, error) {
+	data, err := this.getCodec().Encode(m)
+	if err != nil {
+		return "", fmt.Errorf("Could not encode message [%s] using %s codec: %s", m.Id, this.getCodec().Name(), err.Error())
+	}
+	return string(data), nil
+}
+
+//
+// Entries of list based boxes are framed with a unique token, so that every
+// entry is distinct and can be used as receipt of its delivery.
+// Frame is a zero byte followed by a uuid, no codec output starts with a zero byte.
+//
+const entryFrameLen = 1 + 36
+
+func frameEntry(data string) string {
+	return "\x00" + uuid.New().String() + data
+}
+
+// strip frame from entry, entries written without frame are returned as is.
+func unframeEntry(entry string) string {
+	if len(entry) >= entryFrameLen && entry[0] == 0 {
+		return entry[entryFrameLen:]
+	}
+	return entry
+}
+
+// encode message into a uniquely framed entry.
+func (this *codecHolder) encodeFramed(m *Message) (string, error) {
+	data, err := this.encode(m)
+	if err != nil {
+		return "", err
+	}
+	return frameEntry(data), nil
+}
+
+// decode a, possibly framed, entry.
+func (this *codecHolder) decodeFramed(entry string, m *Message) error {
+	return this.decode(unframeEntry(entry), m)
+}
+
+func (this *codecHolder) decode(data string, m *Message) error {
+	codec := this.getCodec()
+	err := codec.Decode([]byte(data), m)
+	if err == nil {
+		return nil
+	}
+	//entries written before switching codec, are JSON.
+	if _, isJson := codec.(JsonCodec); !isJson && len(data) > 0 && data[0] == '{' {
+		*m = Message{}
+		if jerr := (JsonCodec{}).Decode([]byte(data), m); jerr == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,258 @@
+package raven
+
+import (
+	"strings"
+	"time"
+)
+
+//
+// Selects dead messages to act upon, an empty filter selects all of them.
+//
+type DeadFilter struct {
+	//Ids of messages, any if empty.
+	Ids []string
+
+	//Types of messages, any if empty.
+	Types []string
+
+	//Messages sent at least this long ago, 0 means no bound.
+	MinAge time.Duration
+
+	//Messages sent at most this long ago, 0 means no bound.
+	MaxAge time.Duration
+
+	//Messages whose last error contains this, any if empty.
+	Error string
+
+	//Messages with id starting with this, any if empty.
+	IdPrefix string
+
+	//Messages moved to dead box within this window, zero means no bound.
+	//Messages without a failure time are never selected by a bound.
+	Since time.Time
+	Until time.Time
+}
+
+//
+// Check if message is selected by filter.
+// Messages sent without a timestamp are never selected by an age bound.
+//
+func (this DeadFilter) Matches(m *Message) bool {
+	if len(this.Ids) > 0 && !contains(this.Ids, m.Id) {
+		return false
+	}
+	if len(this.Types) > 0 && !contains(this.Types, m.Type) {
+		return false
+	}
+	if this.Error != "" && (m.Failure == nil || !strings.Contains(m.Failure.LastError, this.Error)) {
+		return false
+	}
+	if this.IdPrefix != "" && !strings.HasPrefix(m.Id, this.IdPrefix) {
+		return false
+	}
+	if !this.Since.IsZero() || !this.Until.IsZero() {
+		if m.Failure == nil || m.Failure.FailedAt.IsZero() {
+			return false
+		}
+		if !this.Since.IsZero() && m.Failure.FailedAt.Before(this.Since) {
+			return false
+		}
+		if !this.Until.IsZero() && m.Failure.FailedAt.After(this.Until) {
+			return false
+		}
+	}
+	if this.MinAge > 0 || this.MaxAge > 0 {
+		if m.SentAt.IsZero() {
+			return false
+		}
+		age := time.Since(m.SentAt)
+		if this.MinAge > 0 && age < this.MinAge {
+			return false
+		}
+		if this.MaxAge > 0 && age > this.MaxAge {
+			return false
+		}
+	}
+	return true
+}
+
+// check if filter selects all messages.
+func (this DeadFilter) isEmpty() bool {
+	return len(this.Ids) == 0 && len(this.Types) == 0 && this.MinAge == 0 && this.MaxAge == 0 &&
+		this.Error == "" && this.IdPrefix == "" && this.Since.IsZero() && this.Until.IsZero()
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+//Max no. of dead messages replayed in one go.
+const REPLAY_BATCH = 100
+
+//
+// A dead message picked for replay, alongwith its position in dead box.
+//
+type deadPick struct {
+	pos int
+	msg *Message
+}
+
+//
+// Pick messages of a dead box matching filter, upto limit if positive.
+// Entries are expected oldest first, so that oldest messages are picked first.
+// Picked messages have their attempts reset, to get a full retry budget again.
+//
+func (this *codecHolder) pickDead(entries []string, filter DeadFilter, limit int) []deadPick {
+	picked := make([]deadPick, 0)
+	for i, entry := range entries {
+		if limit > 0 && len(picked) >= limit {
+			break
+		}
+		m := new(Message)
+		if err := this.decodeFramed(entry, m); err != nil {
+			continue
+		}
+		if !filter.Matches(m) {
+			continue
+		}
+		m.Attempts = 0
+		m.EnqueuedAt = time.Now()
+		picked = append(picked, deadPick{pos: i, msg: m})
+	}
+	return picked
+}
+
+//
+// Replay picked messages in batches of REPLAY_BATCH using f, which returns
+// no. of messages replayed. Returns total no. of messages replayed.
+//
+func replayInBatches(picked []deadPick, f func([]deadPick) (int, error)) (int, error) {
+	var replayed int
+	for start := 0; start < len(picked); start += REPLAY_BATCH {
+		end := start + REPLAY_BATCH
+		if end > len(picked) {
+			end = len(picked)
+		}
+		n, err := f(picked[start:end])
+		replayed += n
+		if err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
+//
+// Act on messages of a dead box matching filter, upto limit if positive, a page of
+// upto DEAD_SCAN_BATCH entries at a time, so that dead box is never loaded as a whole.
+// next returns the page following the previous one, oldest first, given the no. of
+// entries removed from previous page. act is handed a page alongwith messages picked
+// from it, and returns no. of entries it removed from dead box. Scanning stops once
+// limit is reached or, incase filter selects ids, once all of them are picked.
+// Returns total no. of entries removed.
+//
+func (this *codecHolder) scanDead(filter DeadFilter, limit int, next func(removed int) ([]string, error),
+	act func(entries []string, picked []deadPick) (int, error)) (int, error) {
+
+	//ids yet to be picked, nil if filter does not select ids.
+	var pending map[string]bool
+	if len(filter.Ids) > 0 {
+		pending = make(map[string]bool, len(filter.Ids))
+		for _, id := range filter.Ids {
+			pending[id] = true
+		}
+	}
+	var total, removed int
+	for {
+		entries, err := next(removed)
+		if err != nil {
+			return total, err
+		}
+		left := 0
+		if limit > 0 {
+			left = limit - total
+		}
+		picked := this.pickDead(entries, filter, left)
+		removed = 0
+		if len(picked) > 0 {
+			if removed, err = act(entries, picked); err != nil {
+				return total + removed, err
+			}
+		}
+		total += removed
+		for _, p := range picked {
+			delete(pending, p.msg.Id)
+		}
+		if len(entries) < DEAD_SCAN_BATCH || (limit > 0 && total >= limit) || (pending != nil && len(pending) == 0) {
+			return total, nil
+		}
+	}
+}
+
+//
+// Pages of a list based dead box for scanDead, oldest first. fetch returns upto n
+// entries, oldest first, after skipping skip of them from tail.
+//
+func deadListPages(fetch func(skip int, n int) ([]string, error)) func(removed int) ([]string, error) {
+	var skip, last int
+	return func(removed int) ([]string, error) {
+		//entries removed from previous page, no longer sit in front of next one.
+		skip += last - removed
+		entries, err := fetch(skip, DEAD_SCAN_BATCH)
+		last = len(entries)
+		return entries, err
+	}
+}
+
+//
+// Keys of dead entries matching filter, upto limit if positive. Entries are expected
+// oldest first, so that oldest messages are matched first.
+//
+func (this *codecHolder) matchDead(entries []deadEntry, filter DeadFilter, limit int) []string {
+	keys := make([]string, 0)
+	for _, entry := range entries {
+		if limit > 0 && len(keys) >= limit {
+			break
+		}
+		m := new(Message)
+		if err := this.decode(entry.data, m); err != nil || !filter.Matches(m) {
+			continue
+		}
+		keys = append(keys, entry.key)
+	}
+	return keys
+}
+
+//
+// Remove keys in batches of REPLAY_BATCH using f, which returns no. of keys removed.
+// Returns total no. of keys removed.
+//
+func removeInBatches(keys []string, f func([]string) (int, error)) (int, error) {
+	var removed int
+	for start := 0; start < len(keys); start += REPLAY_BATCH {
+		end := start + REPLAY_BATCH
+		if end > len(keys) {
+			end = len(keys)
+		}
+		n, err := f(keys[start:end])
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// reverse entries listed from head to tail, so that oldest come first.
+func oldestFirst(entries []string) []string {
+	reversed := make([]string, len(entries))
+	for i, e := range entries {
+		reversed[len(entries)-1-i] = e
+	}
+	return reversed
+}
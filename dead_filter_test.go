@@ -0,0 +1,109 @@
+package raven
+
+import (
+	"fmt"
+	"testing"
+)
+
+//
+// A list based dead box kept oldest first, recording no. of pages fetched.
+//
+type fakeDeadList struct {
+	entries []string
+	fetched int
+}
+
+func newFakeDeadList(t *testing.T, codec *codecHolder, n int) *fakeDeadList {
+	list := new(fakeDeadList)
+	for i := 0; i < n; i++ {
+		mtype := "even"
+		if i%2 == 1 {
+			mtype = "odd"
+		}
+		m := PrepareMessage(fmt.Sprintf("m%d", i), mtype, "data", "")
+		entry, err := codec.encodeFramed(&m)
+		if err != nil {
+			t.Fatalf("Could not encode message: %s", err)
+		}
+		list.entries = append(list.entries, entry)
+	}
+	return list
+}
+
+func (this *fakeDeadList) fetch(skip int, n int) ([]string, error) {
+	this.fetched++
+	if skip >= len(this.entries) {
+		return nil, nil
+	}
+	end := skip + n
+	if end > len(this.entries) {
+		end = len(this.entries)
+	}
+	return append([]string(nil), this.entries[skip:end]...), nil
+}
+
+func (this *fakeDeadList) remove(entries []string, picked []deadPick) (int, error) {
+	removed := 0
+	for _, p := range picked {
+		for i, e := range this.entries {
+			if e == entries[p.pos] {
+				this.entries = append(this.entries[:i], this.entries[i+1:]...)
+				removed++
+				break
+			}
+		}
+	}
+	return removed, nil
+}
+
+func TestScanDead(t *testing.T) {
+	size := 2*DEAD_SCAN_BATCH + 200
+	cases := []struct {
+		name    string
+		filter  DeadFilter
+		limit   int
+		removed int
+		fetched int
+	}{
+		{"all", DeadFilter{}, 0, size, 3},
+		{"limit within first page", DeadFilter{}, 1, 1, 1},
+		{"limit across pages", DeadFilter{}, DEAD_SCAN_BATCH + 10, DEAD_SCAN_BATCH + 10, 2},
+		{"every other across pages", DeadFilter{Types: []string{"odd"}}, 0, size / 2, 3},
+		{"ids stop once picked", DeadFilter{Ids: []string{"m3", fmt.Sprintf("m%d", DEAD_SCAN_BATCH+3)}}, 0, 2, 2},
+		{"missing id scans all", DeadFilter{Ids: []string{"m3", "missing"}}, 0, 1, 3},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			codec := new(codecHolder)
+			list := newFakeDeadList(t, codec, size)
+			removed, err := codec.scanDead(c.filter, c.limit, deadListPages(list.fetch), list.remove)
+			if err != nil {
+				t.Fatalf("scanDead failed: %s", err)
+			}
+			if removed != c.removed || len(list.entries) != size-c.removed {
+				t.Errorf("removed %d, %d left, want %d removed", removed, len(list.entries), c.removed)
+			}
+			if list.fetched != c.fetched {
+				t.Errorf("fetched %d pages, want %d", list.fetched, c.fetched)
+			}
+		})
+	}
+}
+
+func TestScanDeadOldestFirst(t *testing.T) {
+	codec := new(codecHolder)
+	list := newFakeDeadList(t, codec, 10)
+	var ids []string
+	_, err := codec.scanDead(DeadFilter{}, 3, deadListPages(list.fetch), func(entries []string, picked []deadPick) (int, error) {
+		for _, p := range picked {
+			ids = append(ids, p.msg.Id)
+		}
+		return list.remove(entries, picked)
+	})
+	if err != nil {
+		t.Fatalf("scanDead failed: %s", err)
+	}
+	if fmt.Sprint(ids) != "[m0 m1 m2]" {
+		t.Errorf("picked %v, want oldest first", ids)
+	}
+}
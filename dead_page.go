@@ -0,0 +1,191 @@
+package raven
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+//Dead messages listed in a page, when no limit is specified.
+const DEAD_PAGE_SIZE = 100
+
+//Max dead messages listed in a page.
+const MAX_DEAD_PAGE_SIZE = 1000
+
+//Max no. of dead entries fetched in one go, while browsing.
+const DEAD_SCAN_BATCH = 500
+
+//
+// A page of dead messages, oldest first.
+//
+type DeadPage struct {
+	Messages []*Message
+
+	//Entries that could not be decoded, listed as is.
+	Raw []string `json:",omitempty"`
+
+	//Cursor to fetch next page from, empty once there is nothing left.
+	Next string `json:",omitempty"`
+}
+
+// no. of entries listed in page.
+func (this *DeadPage) size() int {
+	return len(this.Messages) + len(this.Raw)
+}
+
+func newDeadPage() DeadPage {
+	return DeadPage{Messages: make([]*Message, 0)}
+}
+
+// limit of a page, bounded by MAX_DEAD_PAGE_SIZE.
+func pageLimit(limit int) int {
+	if limit <= 0 {
+		return DEAD_PAGE_SIZE
+	}
+	if limit > MAX_DEAD_PAGE_SIZE {
+		return MAX_DEAD_PAGE_SIZE
+	}
+	return limit
+}
+
+//
+// Add a dead entry to page, if it matches filter. Entries that cannot be decoded are
+// added as raw, unless filter selects anything since they cannot be matched against it.
+//
+func (this *codecHolder) collectDead(page *DeadPage, data string, filter DeadFilter) {
+	m := new(Message)
+	if err := this.decode(data, m); err != nil {
+		if filter.isEmpty() {
+			page.Raw = append(page.Raw, data)
+		}
+		return
+	}
+	if filter.Matches(m) {
+		page.Messages = append(page.Messages, m)
+	}
+}
+
+//
+// Position of a list based dead box to browse next page from. The last entry scanned
+// is identified by a hash of it alongwith its time of failure, offset being its
+// position from tail when it was scanned. Entries are only added at head, and are
+// removed by janitor, replay or delete, so that it can only move towards tail.
+//
+type deadCursor struct {
+	offset   int
+	failedAt int64
+	hash     uint64
+}
+
+func (this deadCursor) String() string {
+	return fmt.Sprintf("%d-%d-%x", this.offset, this.failedAt, this.hash)
+}
+
+func parseDeadCursor(cursor string) (deadCursor, error) {
+	var c deadCursor
+	parts := strings.Split(cursor, "-")
+	if len(parts) != 3 {
+		return c, ErrInvalidCursor
+	}
+	var err1, err2, err3 error
+	c.offset, err1 = strconv.Atoi(parts[0])
+	c.failedAt, err2 = strconv.ParseInt(parts[1], 10, 64)
+	c.hash, err3 = strconv.ParseUint(parts[2], 16, 64)
+	if err1 != nil || err2 != nil || err3 != nil || c.offset < 0 {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+func hashDeadEntry(entry string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(entry))
+	return h.Sum64()
+}
+
+// time of failure of a dead entry in unix nanos, 0 if not known.
+func (this *codecHolder) deadEntryFailedAt(entry string) int64 {
+	m := new(Message)
+	if err := this.decode(unframeEntry(entry), m); err != nil {
+		return 0
+	}
+	if m.Failure == nil || m.Failure.FailedAt.IsZero() {
+		return 0
+	}
+	return m.Failure.FailedAt.UnixNano()
+}
+
+// cursor after entry, scanned at offset from tail.
+func (this *codecHolder) newDeadCursor(offset int, entry string) deadCursor {
+	return deadCursor{offset: offset, failedAt: this.deadEntryFailedAt(entry), hash: hashDeadEntry(entry)}
+}
+
+//
+// Find no. of entries from tail to skip, to resume browsing after cursor. Looks for the
+// entry of cursor from its offset towards tail. If it has been removed meanwhile, resumes
+// after the first entry found to have failed before it. Entries may be listed again, but
+// are never skipped.
+//
+func (this *codecHolder) seekDead(c deadCursor, fetch func(skip int, n int) ([]string, error)) (int, error) {
+	for start := c.offset; start > 0; {
+		lo := start - DEAD_SCAN_BATCH
+		if lo < 0 {
+			lo = 0
+		}
+		entries, err := fetch(lo, start-lo)
+		if err != nil {
+			return 0, err
+		}
+		for i := len(entries) - 1; i >= 0; i-- {
+			if hashDeadEntry(entries[i]) == c.hash {
+				return lo + i + 1, nil
+			}
+			if at := this.deadEntryFailedAt(entries[i]); at > 0 && at < c.failedAt {
+				return lo + i + 1, nil
+			}
+		}
+		start = lo
+	}
+	return 0, nil
+}
+
+//
+// Browse a list based dead box from its tail, i.e. oldest first. Cursor identifies the
+// last entry scanned, see deadCursor, so that neither messages dying meanwhile nor ones
+// removed by janitor, replay or delete shift it.
+// fetch returns upto n entries, oldest first, after skipping skip of them from tail.
+//
+func (this *codecHolder) browseDeadList(filter DeadFilter, cursor string, limit int,
+	fetch func(skip int, n int) ([]string, error)) (DeadPage, error) {
+
+	skip := 0
+	if cursor != "" {
+		c, err := parseDeadCursor(cursor)
+		if err != nil {
+			return DeadPage{}, err
+		}
+		if skip, err = this.seekDead(c, fetch); err != nil {
+			return DeadPage{}, err
+		}
+	}
+	limit = pageLimit(limit)
+	page := newDeadPage()
+	for {
+		entries, err := fetch(skip, DEAD_SCAN_BATCH)
+		if err != nil {
+			return page, err
+		}
+		for _, entry := range entries {
+			skip++
+			this.collectDead(&page, unframeEntry(entry), filter)
+			if page.size() >= limit {
+				page.Next = this.newDeadCursor(skip, entry).String()
+				return page, nil
+			}
+		}
+		if len(entries) < DEAD_SCAN_BATCH {
+			return page, nil
+		}
+	}
+}
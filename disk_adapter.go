@@ -0,0 +1,819 @@
+package raven
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Fsync policies for disk manager.
+//
+const DISK_SYNC_ALWAYS = "always"     //fsync after every write.
+const DISK_SYNC_INTERVAL = "interval" //fsync pending writes every SyncInterval.
+const DISK_SYNC_NEVER = "never"       //leave it to OS.
+
+const DISK_SEGMENT_SIZE = 64 * 1024 * 1024
+const DISK_SYNC_INTERVAL_DURATION = time.Second
+
+//Compaction is not attempted till removed records occupy these many bytes.
+const DISK_COMPACT_MIN_BYTES = 4 * 1024 * 1024
+
+//
+// Configuration to Initialize disk manager.
+//
+type DiskConfig struct {
+	//Directory where logs are kept.
+	Dir string
+
+	//Size after which a log segment is rotated, defaults to DISK_SEGMENT_SIZE.
+	SegmentSize int64
+
+	//One of DISK_SYNC_* policies, defaults to DISK_SYNC_INTERVAL.
+	Sync string
+
+	//Used with DISK_SYNC_INTERVAL, defaults to DISK_SYNC_INTERVAL_DURATION.
+	SyncInterval time.Duration
+
+	//Time to wait incase Q is empty, defaults to BLOCK_FOR_DURATION.
+	BlockFor time.Duration
+}
+
+//
+// A Raven Manager that needs nothing but local disk.
+//
+// Every MsgBox (and its processing and dead box) is stored as an append only,
+// segmented log within config.Dir and survives process restarts. Semantics are
+// same as that of redis managers.
+//
+// Dir is locked by the process using it, a second disk manager on it fails with
+// ErrDiskInUse. Entries of boxes are kept in memory as well, disk is only used for
+// durability, so boxes are bounded by memory of process.
+//
+type Disk struct {
+	codecHolder
+	mutex  sync.Mutex
+	config DiskConfig
+	queues map[string]*diskQueue
+
+	//closed and replaced every time a message is pushed, wakes up blocked receivers.
+	notify chan struct{}
+
+	//visibility deadlines of messages being processed, these are not persisted
+	//as processing boxes are recovered on startup anyway.
+	visibility visibilityTracker
+
+	//held till manager quits, see lockDiskDir.
+	lock *os.File
+
+	closed bool
+	quit   chan struct{}
+}
+
+func InitializeDisk(config DiskConfig) (*Disk, error) {
+	if config.SegmentSize <= 0 {
+		config.SegmentSize = DISK_SEGMENT_SIZE
+	}
+	if config.Sync == "" {
+		config.Sync = DISK_SYNC_INTERVAL
+	}
+	if config.SyncInterval <= 0 {
+		config.SyncInterval = DISK_SYNC_INTERVAL_DURATION
+	}
+	if config.BlockFor <= 0 {
+		config.BlockFor = BLOCK_FOR_DURATION
+	}
+	dir, err := filepath.Abs(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	config.Dir = dir
+	lock, err := lockDiskDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	d := new(Disk)
+	d.config = config
+	d.lock = lock
+	d.queues = make(map[string]*diskQueue)
+	d.notify = make(chan struct{})
+	d.quit = make(chan struct{})
+	if config.Sync == DISK_SYNC_INTERVAL {
+		go d.startSyncer()
+	}
+	return d, nil
+}
+
+// periodically fsync queues having pending writes.
+func (this *Disk) startSyncer() {
+	ticker := time.NewTicker(this.config.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.quit:
+			return
+		case <-ticker.C:
+			this.mutex.Lock()
+			for _, q := range this.queues {
+				q.flush()
+			}
+			this.mutex.Unlock()
+		}
+	}
+}
+
+// get queue for a box, opening (and recovering) it if required.
+// expects mutex to be held.
+func (this *Disk) queue(box MsgBox) (*diskQueue, error) {
+	name := box.GetName()
+	if q, ok := this.queues[name]; ok {
+		return q, nil
+	}
+	dir := filepath.Join(this.config.Dir, url.PathEscape(name))
+	q, err := openDiskQueue(dir, this.config.SegmentSize, this.config.Sync)
+	if err != nil {
+		return nil, err
+	}
+	this.queues[name] = q
+	return q, nil
+}
+
+func (this *Disk) wakeup() {
+	close(this.notify)
+	this.notify = make(chan struct{})
+}
+
+//
+// Move entry matching receipt from source to destination, entry at tail is
+// moved if receipt is empty. Entry is first written to destination and then removed from source,
+// so a crash in between may duplicate but never loose it.
+// expects mutex to be held.
+//
+func (this *Disk) move(source *diskQueue, dest *diskQueue, receipt string, toTail bool) (string, bool, error) {
+	entry, ok := source.tail()
+	if receipt != "" {
+		entry, ok = source.find(receipt)
+	}
+	if !ok {
+		return "", false, nil
+	}
+	if dest != nil {
+		var err error
+		if toTail {
+			err = dest.pushTail(entry.data)
+		} else {
+			err = dest.pushHead(entry.data)
+		}
+		if err != nil {
+			return "", false, err
+		}
+	}
+	if err := source.remove(entry.id); err != nil {
+		return "", false, err
+	}
+	return entry.data, true, nil
+}
+
+//
+// Pop from tail of source and, if a destination is specified, push it to head of
+// destination. Blocks till BlockFor in case source is empty.
+//
+func (this *Disk) brpoplpush(source MsgBox, dest *MsgBox) (string, error) {
+	deadline := time.Now().Add(this.config.BlockFor)
+	for {
+		this.mutex.Lock()
+		if this.closed {
+			this.mutex.Unlock()
+			return "", ErrManagerClosed
+		}
+		src, err := this.queue(source)
+		if err != nil {
+			this.mutex.Unlock()
+			return "", err
+		}
+		var dst *diskQueue
+		if dest != nil {
+			if dst, err = this.queue(*dest); err != nil {
+				this.mutex.Unlock()
+				return "", err
+			}
+		}
+		data, ok, err := this.move(src, dst, "", false)
+		if err != nil || ok {
+			this.mutex.Unlock()
+			return data, err
+		}
+		wait := this.notify
+		this.mutex.Unlock()
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return "", ErrEmptyQueue
+		}
+		timer := time.NewTimer(remaining)
+		select {
+		case <-wait:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+//
+//  Implementation of Send() method exposed by raven manager.
+//
+func (this *Disk) Send(message Message, dest Destination) error {
+
+	box, err := dest.GetBox4Msg(message)
+	if err != nil {
+		return err
+	}
+	data, err := this.encodeFramed(&message)
+	if err != nil {
+		return err
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		return ErrManagerClosed
+	}
+	q, err := this.queue(*box)
+	if err != nil {
+		return err
+	}
+	if err := q.pushHead(data); err != nil {
+		return err
+	}
+	this.wakeup()
+	return nil
+}
+
+//
+// Scheduled messages are kept in a separate log against the box,
+// each entry prefixed with its delivery time.
+//
+func (this *Disk) SendAt(message Message, dest Destination, at time.Time) error {
+
+	box, err := dest.GetBox4Msg(message)
+	if err != nil {
+		return err
+	}
+	data, err := this.encodeFramed(&message)
+	if err != nil {
+		return err
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		return ErrManagerClosed
+	}
+	return this.schedule(*box, data, at)
+}
+
+// caller has to hold the lock.
+func (this *Disk) schedule(box MsgBox, data string, at time.Time) error {
+	q, err := this.queue(box.getScheduledBox())
+	if err != nil {
+		return err
+	}
+	return q.pushHead(strconv.FormatInt(at.UnixNano(), 10) + "|" + data)
+}
+
+func (this *Disk) PromoteScheduled(r MsgReceiver) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	scheduled, err := this.queue(r.msgbox.getScheduledBox())
+	if err != nil {
+		return 0, err
+	}
+	if scheduled.len() == 0 {
+		return 0, nil
+	}
+	box, err := this.queue(r.msgbox)
+	if err != nil {
+		return 0, err
+	}
+	type due struct {
+		at    int64
+		entry diskEntry
+		data  string
+	}
+	now := time.Now().UnixNano()
+	dues := make([]due, 0)
+	for _, entry := range scheduled.all() {
+		parts := strings.SplitN(entry.data, "|", 2)
+		at, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || len(parts) != 2 {
+			//not a valid entry, drop it.
+			scheduled.remove(entry.id)
+			continue
+		}
+		if at <= now {
+			dues = append(dues, due{at: at, entry: entry, data: parts[1]})
+		}
+	}
+	sort.SliceStable(dues, func(i, j int) bool {
+		return dues[i].at < dues[j].at
+	})
+	//written to box before being removed from schedule, never lost.
+	for _, d := range dues {
+		if err := box.pushHead(d.data); err != nil {
+			return 0, err
+		}
+		if err := scheduled.remove(d.entry.id); err != nil {
+			return 0, err
+		}
+	}
+	if len(dues) > 0 {
+		this.wakeup()
+	}
+	return len(dues), nil
+}
+
+func (this *Disk) Receive(r MsgReceiver) (*Message, error) {
+
+	var message string
+	var err error
+	if !r.options.isReliable {
+		message, err = this.brpoplpush(r.msgbox, nil)
+	} else {
+		message, err = this.brpoplpush(r.msgbox, &r.procBox)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m *Message = new(Message)
+	if err := this.decodeFramed(message, m); err != nil {
+		if r.options.isReliable {
+			this.mutex.Lock()
+			err := this.failEntry(r, message, message)
+			this.mutex.Unlock()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, ErrUndecodable
+	}
+	if r.options.isReliable {
+		m.receipt = message
+		if timeout := r.options.visibilityTimeout; timeout > 0 {
+			this.mutex.Lock()
+			this.visibility.track(r.procBox.GetName(), message, time.Now().Add(timeout))
+			this.mutex.Unlock()
+		}
+	}
+	return m, nil
+}
+
+func (this *Disk) MarkProcessed(m *Message, r MsgReceiver) error {
+
+	if !r.options.isReliable {
+		return nil
+	}
+	receipt := receiptOf(m)
+	if receipt == "" {
+		return ErrInvalidReceipt
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	proc, err := this.queue(r.procBox)
+	if err != nil {
+		return err
+	}
+	this.visibility.untrack(r.procBox.GetName(), receipt)
+	_, _, err = this.move(proc, nil, receipt, false)
+	return err
+}
+
+func (this *Disk) MarkFailed(m *Message, r MsgReceiver) error {
+
+	if m == nil || (!r.options.isReliable) {
+		return nil //nothing to do
+	}
+	if m.receipt == "" {
+		return ErrInvalidReceipt
+	}
+	data, err := this.encodeFramed(m)
+	if err != nil {
+		return err
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.failEntry(r, m.receipt, data)
+}
+
+// move entry of receipt from processing box to dead box as data, mutex is held by caller.
+func (this *Disk) failEntry(r MsgReceiver, receipt string, data string) error {
+	proc, err := this.queue(r.procBox)
+	if err != nil {
+		return err
+	}
+	dead, err := this.queue(r.deadBox)
+	if err != nil {
+		return err
+	}
+	this.visibility.untrack(r.procBox.GetName(), receipt)
+	entry, ok := proc.find(receipt)
+	if !ok {
+		return nil
+	}
+	//message is pushed to dead box first, a crash in between leads to a duplicate
+	//rather than a lost message.
+	if err := dead.pushHead(data); err != nil {
+		return err
+	}
+	return proc.remove(entry.id)
+}
+
+//
+// Recover queues of the receiver from disk and move any pending items
+// from processingQ to sourceQ.
+//
+func (this *Disk) PreStartup(r MsgReceiver) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	box, err := this.queue(r.msgbox)
+	if err != nil {
+		return err
+	}
+	if !r.options.isReliable {
+		//no processingQ specified. nothing to do
+		return nil
+	}
+	proc, err := this.queue(r.procBox)
+	if err != nil {
+		return err
+	}
+	if _, err := this.queue(r.deadBox); err != nil {
+		return err
+	}
+	for {
+		_, ok, err := this.move(proc, box, "", true)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+	}
+	this.visibility.reset(r.procBox.GetName())
+	this.wakeup()
+	return nil
+}
+
+func (this *Disk) ReapExpired(r MsgReceiver) (int, error) {
+	if !r.options.isReliable || r.options.visibilityTimeout <= 0 {
+		return 0, nil
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	box, err := this.queue(r.msgbox)
+	if err != nil {
+		return 0, err
+	}
+	proc, err := this.queue(r.procBox)
+	if err != nil {
+		return 0, err
+	}
+	name := r.procBox.GetName()
+	live := proc.list()
+	expired := this.visibility.reap(name, live, r.options.visibilityTimeout)
+	var reaped int
+	for _, receipt := range live {
+		expiries, ok := expired[receipt]
+		if !ok {
+			continue
+		}
+		if r.options.maxExpiries > 0 && expiries >= r.options.maxExpiries {
+			if err := this.failEntry(r, receipt, this.expiredEntry(r, receipt, expiries)); err != nil {
+				return reaped, err
+			}
+			reaped++
+			continue
+		}
+		entry, ok := proc.find(receipt)
+		if !ok {
+			continue
+		}
+		//new receipt, so that a late ack of expired delivery does not affect it.
+		fresh := frameEntry(unframeEntry(receipt))
+		if err := box.pushTail(fresh); err != nil {
+			return reaped, err
+		}
+		if err := proc.remove(entry.id); err != nil {
+			return reaped, err
+		}
+		this.visibility.carry(name, fresh, expiries)
+		reaped++
+	}
+	if reaped > 0 {
+		this.wakeup()
+	}
+	return reaped, nil
+}
+
+func (this *Disk) KillReceiver(r RavenReceiver) error {
+	return ErrNotImplemented
+}
+
+func (this *Disk) RequeMessage(message Message, r MsgReceiver) error {
+	if r.options.isReliable && message.receipt == "" {
+		return ErrInvalidReceipt
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	box, err := this.queue(r.msgbox)
+	if err != nil {
+		return err
+	}
+	defer this.wakeup()
+	if !r.options.isReliable {
+		//simply reque message
+		data, err := this.encodeFramed(&message)
+		if err != nil {
+			return err
+		}
+		return box.pushTail(data)
+	}
+	//reque and remove from processing.
+	proc, err := this.queue(r.procBox)
+	if err != nil {
+		return err
+	}
+	this.visibility.untrack(r.procBox.GetName(), message.receipt)
+	_, _, err = this.move(proc, box, message.receipt, true)
+	return err
+}
+
+//
+// Message is scheduled before being removed from processing box,
+// a crash in between leads to a redelivery rather than a lost message.
+//
+func (this *Disk) DelayMessage(message Message, r MsgReceiver, at time.Time) error {
+	if r.options.isReliable && message.receipt == "" {
+		return ErrInvalidReceipt
+	}
+	data, err := this.encodeFramed(&message)
+	if err != nil {
+		return err
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if err := this.schedule(r.msgbox, data, at); err != nil {
+		return err
+	}
+	if !r.options.isReliable {
+		return nil
+	}
+	proc, err := this.queue(r.procBox)
+	if err != nil {
+		return err
+	}
+	this.visibility.untrack(r.procBox.GetName(), message.receipt)
+	_, _, err = this.move(proc, nil, message.receipt, false)
+	return err
+}
+
+func (this *Disk) ShowDeadQ(r MsgReceiver) ([]*Message, error) {
+	if !r.options.isReliable {
+		return nil, nil //no deadQ
+	}
+	this.mutex.Lock()
+	dead, err := this.queue(r.deadBox)
+	if err != nil {
+		this.mutex.Unlock()
+		return nil, err
+	}
+	data := dead.list()
+	this.mutex.Unlock()
+
+	msgs := make([]*Message, 0, len(data))
+	for _, v := range data {
+		m := new(Message)
+		err := this.decodeFramed(v, m)
+		if err != nil {
+			continue
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+func (this *Disk) BrowseDeadQ(r MsgReceiver, filter DeadFilter, cursor string, limit int) (DeadPage, error) {
+	if !r.options.isReliable {
+		return newDeadPage(), nil //no deadQ
+	}
+	return this.browseDeadList(filter, cursor, limit, func(skip int, n int) ([]string, error) {
+		this.mutex.Lock()
+		defer this.mutex.Unlock()
+		dead, err := this.queue(r.deadBox)
+		if err != nil {
+			return nil, err
+		}
+		return dead.fromTail(skip, n), nil
+	})
+}
+
+func (this *Disk) FlushDeadQ(r MsgReceiver) error {
+	if !r.options.isReliable {
+		return nil //no deadQ
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	dead, err := this.queue(r.deadBox)
+	if err != nil {
+		return err
+	}
+	return dead.reset()
+}
+
+//
+// Replayed message is written to box before being removed from dead box,
+// a crash in between leads to a duplicate rather than a lost message.
+//
+func (this *Disk) ReplayDead(r MsgReceiver, filter DeadFilter, limit int) (int, error) {
+	if !r.options.isReliable {
+		return 0, nil //no deadQ
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	box, err := this.queue(r.msgbox)
+	if err != nil {
+		return 0, err
+	}
+	dead, err := this.queue(r.deadBox)
+	if err != nil {
+		return 0, err
+	}
+	all := dead.all()
+	entries := make([]string, len(all))
+	for i, e := range all {
+		entries[len(all)-1-i] = e.data
+	}
+	var replayed int
+	defer func() {
+		if replayed > 0 {
+			this.wakeup()
+		}
+	}()
+	for _, p := range this.pickDead(entries, filter, limit) {
+		fresh, err := this.encodeFramed(p.msg)
+		if err != nil {
+			return replayed, err
+		}
+		if err := box.pushHead(fresh); err != nil {
+			return replayed, err
+		}
+		if err := dead.remove(all[len(all)-1-p.pos].id); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	return replayed, nil
+}
+
+func (this *Disk) DeleteDead(r MsgReceiver, filter DeadFilter, limit int) (int, error) {
+	if !r.options.isReliable {
+		return 0, nil //no deadQ
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	dead, err := this.queue(r.deadBox)
+	if err != nil {
+		return 0, err
+	}
+	var deleted int
+	for _, k := range this.matchDead(listDeadEntries(dead.fromTail(0, dead.len())), filter, limit) {
+		entry, ok := dead.find(k)
+		if !ok {
+			continue
+		}
+		if err := dead.remove(entry.id); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+func (this *Disk) ExpireDead(r MsgReceiver, retention DeadRetention) (int, error) {
+	if !r.options.isReliable {
+		return 0, nil //no deadQ
+	}
+	//dead queue, under lock.
+	withDead := func(f func(dead *diskQueue) error) error {
+		this.mutex.Lock()
+		defer this.mutex.Unlock()
+		dead, err := this.queue(r.deadBox)
+		if err != nil {
+			return err
+		}
+		return f(dead)
+	}
+	return this.expireDead(retention, r.id,
+		func() (n int, err error) {
+			err = withDead(func(dead *diskQueue) error {
+				n = dead.len()
+				return nil
+			})
+			return n, err
+		},
+		listDeadEntryPages(func(skip int, n int) (entries []string, err error) {
+			err = withDead(func(dead *diskQueue) error {
+				entries = dead.fromTail(skip, n)
+				return nil
+			})
+			return entries, err
+		}),
+		func(keys []string) (removed int, err error) {
+			err = withDead(func(dead *diskQueue) error {
+				for _, k := range keys {
+					entry, ok := dead.find(k)
+					if !ok {
+						continue
+					}
+					if err := dead.remove(entry.id); err != nil {
+						return err
+					}
+					removed++
+				}
+				return nil
+			})
+			return removed, err
+		},
+	)
+}
+
+func (this *Disk) InFlightMessages(r MsgReceiver) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	box, err := this.queue(r.msgbox)
+	if err != nil {
+		return 0, err
+	}
+	return box.len(), nil
+}
+
+func (this *Disk) GetDeadQCount(r MsgReceiver) (int, error) {
+	if !r.options.isReliable {
+		return 0, nil //no deadQ
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	dead, err := this.queue(r.deadBox)
+	if err != nil {
+		return 0, err
+	}
+	return dead.len(), nil
+}
+
+func (this *Disk) FlushAll(r MsgReceiver) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, box := range []MsgBox{r.msgbox, r.procBox, r.deadBox, r.msgbox.getScheduledBox()} {
+		if box.GetName() == "" {
+			continue
+		}
+		q, err := this.queue(box)
+		if err != nil {
+			return err
+		}
+		if err := q.reset(); err != nil {
+			return err
+		}
+	}
+	this.visibility.reset(r.procBox.GetName())
+	return nil
+}
+
+//
+// Quit flushes and closes all logs, blocked receivers are woken up and
+// any further call fails with ErrManagerClosed.
+//
+func (this *Disk) Quit(r MsgReceiver) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		return nil
+	}
+	this.closed = true
+	close(this.quit)
+	this.wakeup()
+	var err error
+	for name, q := range this.queues {
+		if cerr := q.close(); cerr != nil {
+			err = cerr
+		}
+		delete(this.queues, name)
+	}
+	if cerr := this.lock.Close(); cerr != nil {
+		err = cerr
+	}
+	return err
+}
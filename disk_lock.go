@@ -0,0 +1,34 @@
+//go:build !windows
+
+package raven
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+//File within directory of disk manager, locked by the process using it.
+const DISK_LOCK_FILE = ".lock"
+
+//
+// Lock dir exclusively, so that no other disk manager appends to or compacts its
+// logs meanwhile. Lock is released on closing the returned file, or on exit.
+//
+func lockDiskDir(dir string) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, DISK_LOCK_FILE), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrDiskInUse
+		}
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,20 @@
+package raven
+
+import (
+	"os"
+	"path/filepath"
+)
+
+//File within directory of disk manager, locked by the process using it.
+const DISK_LOCK_FILE = ".lock"
+
+//
+// Locking dir is not supported on windows, lock file is merely created. Make sure
+// no two processes are given the same directory.
+//
+func lockDiskDir(dir string) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(filepath.Join(dir, DISK_LOCK_FILE), os.O_CREATE|os.O_RDWR, 0644)
+}
@@ -0,0 +1,441 @@
+package raven
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//
+// Operations recorded in a disk log.
+//
+const (
+	diskOpPushHead byte = 1 //LPUSH, newest message.
+	diskOpPushTail byte = 2 //RPUSH, next message to be consumed.
+	diskOpRemove   byte = 3 //entry consumed / acked.
+)
+
+// length + crc + op + id
+const diskRecordHeader = 4 + 4 + 1 + 8
+
+const diskSegmentExt = ".log"
+
+//
+// A single entry living in a disk queue.
+//
+type diskEntry struct {
+	id   uint64
+	data string
+	//size of the push record on disk.
+	size int64
+}
+
+//
+// diskQueue is an append only, segmented log backing a single MsgBox.
+// Every push and remove is appended as a record, the live entries are kept in
+// memory and rebuilt by replaying segments when the queue is opened.
+// Once the removed entries outweigh live ones, log is compacted into a single
+// segment holding just the live entries.
+//
+// diskQueue is not safe for concurrent use, caller has to synchronize.
+//
+type diskQueue struct {
+	dir     string
+	sync    string
+	segSize int64
+
+	//front is the head (LPUSH side), back is the tail (POP side).
+	entries *list.List
+	index   map[uint64]*list.Element
+	nextId  uint64
+
+	segments   []int
+	active     *os.File
+	activeSize int64
+
+	totalBytes int64
+	liveBytes  int64
+	dirty      bool
+}
+
+func openDiskQueue(dir string, segSize int64, sync string) (*diskQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	q := &diskQueue{
+		dir:     dir,
+		sync:    sync,
+		segSize: segSize,
+		entries: list.New(),
+		index:   make(map[uint64]*list.Element),
+		nextId:  1,
+	}
+	if err := q.replay(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (this *diskQueue) segmentPath(idx int) string {
+	return filepath.Join(this.dir, fmt.Sprintf("%010d%s", idx, diskSegmentExt))
+}
+
+//
+// Rebuild state of queue from segments on disk.
+// A partially written record at the end of last segment (crash while appending)
+// is truncated, corruption anywhere else is reported as error.
+//
+func (this *diskQueue) replay() error {
+	files, err := os.ReadDir(this.dir)
+	if err != nil {
+		return err
+	}
+	segments := make([]int, 0, len(files))
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasSuffix(name, diskSegmentExt+".tmp") {
+			//leftover of an interrupted compaction.
+			os.Remove(filepath.Join(this.dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, diskSegmentExt) {
+			continue
+		}
+		idx, err := strconv.Atoi(strings.TrimSuffix(name, diskSegmentExt))
+		if err != nil {
+			continue
+		}
+		segments = append(segments, idx)
+	}
+	sort.Ints(segments)
+
+	for i, idx := range segments {
+		if err := this.readSegment(idx, i == len(segments)-1); err != nil {
+			return err
+		}
+	}
+	if len(segments) == 0 {
+		segments = append(segments, 1)
+	}
+	this.segments = segments
+	return this.openActive(segments[len(segments)-1])
+}
+
+func (this *diskQueue) readSegment(idx int, last bool) error {
+	path := this.segmentPath(idx)
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var offset int
+	for offset < len(buf) {
+		op, id, data, size, err := decodeDiskRecord(buf[offset:])
+		if err != nil {
+			if !last {
+				return fmt.Errorf("Disk log segment [%s] is corrupt at offset %d: %s", path, offset, err.Error())
+			}
+			return os.Truncate(path, int64(offset))
+		}
+		this.apply(op, id, data, int64(size))
+		this.totalBytes += int64(size)
+		offset += size
+	}
+	return nil
+}
+
+// apply a record to in memory state.
+func (this *diskQueue) apply(op byte, id uint64, data string, size int64) {
+	if id >= this.nextId {
+		this.nextId = id + 1
+	}
+	switch op {
+	case diskOpPushHead, diskOpPushTail:
+		if _, ok := this.index[id]; ok {
+			//already applied, record duplicated by an interrupted compaction.
+			return
+		}
+		entry := diskEntry{id: id, data: data, size: size}
+		if op == diskOpPushHead {
+			this.index[id] = this.entries.PushFront(entry)
+		} else {
+			this.index[id] = this.entries.PushBack(entry)
+		}
+		this.liveBytes += size
+	case diskOpRemove:
+		if e, ok := this.index[id]; ok {
+			this.liveBytes -= e.Value.(diskEntry).size
+			this.entries.Remove(e)
+			delete(this.index, id)
+		}
+	}
+}
+
+func encodeDiskRecord(op byte, id uint64, data string) []byte {
+	buf := make([]byte, diskRecordHeader+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(1+8+len(data)))
+	buf[8] = op
+	binary.BigEndian.PutUint64(buf[9:17], id)
+	copy(buf[17:], data)
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(buf[8:]))
+	return buf
+}
+
+func decodeDiskRecord(buf []byte) (op byte, id uint64, data string, size int, err error) {
+	if len(buf) < diskRecordHeader {
+		return 0, 0, "", 0, io.ErrUnexpectedEOF
+	}
+	length := int(binary.BigEndian.Uint32(buf[0:4]))
+	if length < 9 || len(buf) < 8+length {
+		return 0, 0, "", 0, io.ErrUnexpectedEOF
+	}
+	body := buf[8 : 8+length]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(buf[4:8]) {
+		return 0, 0, "", 0, fmt.Errorf("checksum mismatch")
+	}
+	return body[0], binary.BigEndian.Uint64(body[1:9]), string(body[9:]), 8 + length, nil
+}
+
+func (this *diskQueue) openActive(idx int) error {
+	f, err := os.OpenFile(this.segmentPath(idx), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	this.active = f
+	this.activeSize = stat.Size()
+	return nil
+}
+
+// append a record to active segment, rotating segment if required.
+func (this *diskQueue) append(op byte, id uint64, data string) (int64, error) {
+	buf := encodeDiskRecord(op, id, data)
+	if _, err := this.active.Write(buf); err != nil {
+		return 0, err
+	}
+	size := int64(len(buf))
+	this.activeSize += size
+	this.totalBytes += size
+	if this.sync == DISK_SYNC_ALWAYS {
+		if err := this.active.Sync(); err != nil {
+			return 0, err
+		}
+	} else {
+		this.dirty = true
+	}
+	if this.activeSize >= this.segSize {
+		if err := this.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+func (this *diskQueue) rotate() error {
+	if err := this.flush(); err != nil {
+		return err
+	}
+	if err := this.active.Close(); err != nil {
+		return err
+	}
+	next := this.segments[len(this.segments)-1] + 1
+	this.segments = append(this.segments, next)
+	return this.openActive(next)
+}
+
+func (this *diskQueue) push(op byte, data string) error {
+	id := this.nextId
+	size, err := this.append(op, id, data)
+	if err != nil {
+		return err
+	}
+	this.apply(op, id, data, size)
+	return nil
+}
+
+// Add entry at head of queue.
+func (this *diskQueue) pushHead(data string) error {
+	return this.push(diskOpPushHead, data)
+}
+
+// Add entry at tail of queue, making it the next one to be consumed.
+func (this *diskQueue) pushTail(data string) error {
+	return this.push(diskOpPushTail, data)
+}
+
+// Entry at tail of queue, i.e next to be consumed.
+func (this *diskQueue) tail() (diskEntry, bool) {
+	e := this.entries.Back()
+	if e == nil {
+		return diskEntry{}, false
+	}
+	return e.Value.(diskEntry), true
+}
+
+func (this *diskQueue) remove(id uint64) error {
+	if _, ok := this.index[id]; !ok {
+		return nil
+	}
+	if _, err := this.append(diskOpRemove, id, ""); err != nil {
+		return err
+	}
+	this.apply(diskOpRemove, id, "", 0)
+	return this.maybeCompact()
+}
+
+// Entry nearest to tail with the given data.
+func (this *diskQueue) find(data string) (diskEntry, bool) {
+	for e := this.entries.Back(); e != nil; e = e.Prev() {
+		if entry := e.Value.(diskEntry); entry.data == data {
+			return entry, true
+		}
+	}
+	return diskEntry{}, false
+}
+
+func (this *diskQueue) len() int {
+	return this.entries.Len()
+}
+
+// all live entries from head to tail.
+func (this *diskQueue) all() []diskEntry {
+	entries := make([]diskEntry, 0, this.entries.Len())
+	for e := this.entries.Front(); e != nil; e = e.Next() {
+		entries = append(entries, e.Value.(diskEntry))
+	}
+	return entries
+}
+
+// entries from head to tail.
+func (this *diskQueue) list() []string {
+	data := make([]string, 0, this.entries.Len())
+	for e := this.entries.Front(); e != nil; e = e.Next() {
+		data = append(data, e.Value.(diskEntry).data)
+	}
+	return data
+}
+
+// upto n entries from tail towards head, after skipping skip of them.
+func (this *diskQueue) fromTail(skip int, n int) []string {
+	data := make([]string, 0, n)
+	for e := this.entries.Back(); e != nil && len(data) < n; e = e.Prev() {
+		if skip > 0 {
+			skip--
+			continue
+		}
+		data = append(data, e.Value.(diskEntry).data)
+	}
+	return data
+}
+
+// compact once removed records outweigh live ones.
+func (this *diskQueue) maybeCompact() error {
+	dead := this.totalBytes - this.liveBytes
+	if dead < DISK_COMPACT_MIN_BYTES || dead < this.liveBytes {
+		return nil
+	}
+	return this.compact()
+}
+
+//
+// Rewrite live entries into a new segment and drop all older segments.
+// New segment is written aside and renamed in place, so a crash at any point
+// leaves either old or new segments to replay from. In case both survive,
+// duplicate pushes are ignored during replay.
+//
+func (this *diskQueue) compact() error {
+	next := this.segments[len(this.segments)-1] + 1
+	path := this.segmentPath(next)
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	var written int64
+	//write from tail to head, so that replay of pushes restores the order.
+	for e := this.entries.Back(); e != nil; e = e.Prev() {
+		entry := e.Value.(diskEntry)
+		buf := encodeDiskRecord(diskOpPushHead, entry.id, entry.data)
+		if _, err := tmp.Write(buf); err != nil {
+			tmp.Close()
+			return err
+		}
+		entry.size = int64(len(buf))
+		e.Value = entry
+		written += entry.size
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	syncDir(this.dir)
+
+	this.active.Close()
+	for _, idx := range this.segments {
+		os.Remove(this.segmentPath(idx))
+	}
+	this.segments = []int{next}
+	this.totalBytes = written
+	this.liveBytes = written
+	this.dirty = false
+	return this.openActive(next)
+}
+
+// fsync active segment if there are pending writes.
+func (this *diskQueue) flush() error {
+	if !this.dirty {
+		return nil
+	}
+	this.dirty = false
+	return this.active.Sync()
+}
+
+// remove all entries alongwith segments.
+func (this *diskQueue) reset() error {
+	this.active.Close()
+	for _, idx := range this.segments {
+		if err := os.Remove(this.segmentPath(idx)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	next := this.segments[len(this.segments)-1] + 1
+	this.entries.Init()
+	this.index = make(map[uint64]*list.Element)
+	this.segments = []int{next}
+	this.totalBytes = 0
+	this.liveBytes = 0
+	this.dirty = false
+	return this.openActive(next)
+}
+
+func (this *diskQueue) close() error {
+	if err := this.flush(); err != nil {
+		return err
+	}
+	return this.active.Close()
+}
+
+// fsync a directory so that renames and creates are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
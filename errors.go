@@ -24,3 +24,25 @@ var ErrNotImplemented error = errors.New("Feature Not Implemented")
 
 //To be used when a temporary error is encountered.
 var ErrTmpFailure error = errors.New("Temporary Failure")
+
+//Message was not received in reliable mode, so it cannot be acked.
+var ErrInvalidReceipt error = errors.New("Message does not carry a valid receipt")
+
+//No handler is defined for type of the message.
+var ErrUnknownType error = errors.New("No handler defined for message type")
+
+//Manager has been shut down via Quit.
+var ErrManagerClosed error = errors.New("Raven Manager is closed")
+
+//Cursor supplied for browsing dead messages is not valid.
+var ErrInvalidCursor error = errors.New("Invalid cursor")
+
+//Receiver has no message box with the given id.
+var ErrUnknownBox error = errors.New("No such message box in receiver")
+
+//Message received could not be decoded, for instance it was sent using another codec.
+//It is moved to dead box as is, incase receiver is reliable.
+var ErrUndecodable error = errors.New("Message could not be decoded")
+
+//Directory of disk manager is already in use by another disk manager.
+var ErrDiskInUse error = errors.New("Disk directory is in use by another process")
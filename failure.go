@@ -0,0 +1,103 @@
+package raven
+
+import (
+	"fmt"
+	"time"
+)
+
+//Max no. of errors kept in history of a message.
+const MAX_ERROR_HISTORY = 10
+
+//
+// Why processing of a message failed, carried by the message from its first failure
+// onwards, so that dead messages can be triaged without going through logs.
+// Failure is kept when a dead message is replayed, its history continues from there.
+// Messages moved to dead box by reaper, on running out of visibility timeout expiries,
+// carry a failure recording no. of times it expired.
+//
+type Failure struct {
+	//Error of the last failed attempt, including stack in case of a panic.
+	LastError string
+
+	//Errors of failed attempts, oldest first, upto MAX_ERROR_HISTORY of them.
+	Errors []AttemptError `json:",omitempty"`
+
+	//No. of attempts made before message was moved to dead box.
+	Attempts int `json:",omitempty"`
+
+	//Id of receiver and message box, message was moved to dead box by.
+	Receiver string `json:",omitempty"`
+	Box      string `json:",omitempty"`
+
+	//Time when message was last moved to dead box, zero till it is.
+	FailedAt time.Time
+}
+
+//
+// Error of a failed attempt of processing a message.
+//
+type AttemptError struct {
+	//Attempt that failed, starting from 1.
+	Attempt int
+
+	Error string
+
+	At time.Time
+}
+
+//
+// Record error of a failed attempt in failure of message.
+//
+func (this *Message) recordFailure(err error) {
+	if this.Failure == nil {
+		this.Failure = new(Failure)
+	}
+	this.Failure.LastError = err.Error()
+	this.Failure.Errors = append(this.Failure.Errors, AttemptError{
+		Attempt: this.Attempts + 1,
+		Error:   this.Failure.LastError,
+		At:      time.Now(),
+	})
+	if n := len(this.Failure.Errors); n > MAX_ERROR_HISTORY {
+		this.Failure.Errors = this.Failure.Errors[n-MAX_ERROR_HISTORY:]
+	}
+}
+
+//
+// Record in failure of message, that it is being moved to dead box of msgreceiver.
+//
+func (this *Message) recordDeath(r *MsgReceiver) {
+	if this.Failure == nil {
+		this.Failure = new(Failure)
+	}
+	this.Failure.Attempts = this.Attempts + 1
+	this.Failure.Receiver = r.parent.GetId()
+	this.Failure.Box = r.msgbox.GetName()
+	this.Failure.FailedAt = time.Now()
+}
+
+//
+// Record in failure of message, that it is being moved to dead box of msgreceiver by
+// reaper, on its visibility timeout expiring expiries times.
+//
+func (this *Message) recordExpiry(r *MsgReceiver, expiries int) {
+	this.recordFailure(fmt.Errorf("visibility timeout expired %d times", expiries))
+	this.recordDeath(r)
+}
+
+//
+// Dead entry of a message whose visibility timeout expired expiries times, with
+// expiry recorded in its failure. Entries that cannot be decoded are returned as is.
+//
+func (this *codecHolder) expiredEntry(r MsgReceiver, entry string, expiries int) string {
+	m := new(Message)
+	if err := this.decodeFramed(entry, m); err != nil {
+		return entry
+	}
+	m.recordExpiry(&r, expiries)
+	data, err := this.encodeFramed(m)
+	if err != nil {
+		return entry
+	}
+	return data
+}
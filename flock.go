@@ -0,0 +1,95 @@
+package raven
+
+import (
+	"context"
+	"time"
+)
+
+//Max no. of messages handed over to manager in one go, while flying a batch.
+const FLY_BATCH_SIZE = 1000
+
+//
+// Implemented by managers that can send many messages at once, faster than sending
+// them one at a time. Errors are returned for each message, nil if it was sent.
+//
+type BatchSender interface {
+	SendBatch(messages []Message, destination Destination) []error
+}
+
+//
+// Send messages to destination in bulk. Managers implementing BatchSender, like
+// redis ones, send them in chunks of FLY_BATCH_SIZE using a round trip for each
+// chunk, others send them one at a time.
+// Returns an error for each message, nil if it was sent.
+//
+func (this *Farm) FlyBatch(dest Destination, msgs []Message) []error {
+	errs := make([]error, len(msgs))
+	if err := dest.Validate(); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	for start := 0; start < len(msgs); start += FLY_BATCH_SIZE {
+		end := start + FLY_BATCH_SIZE
+		if end > len(msgs) {
+			end = len(msgs)
+		}
+		this.flyBatch(dest, msgs[start:end], errs[start:end])
+	}
+	return errs
+}
+
+// send a chunk of messages, recording error of each in errs.
+func (this *Farm) flyBatch(dest Destination, msgs []Message, errs []error) {
+	now := time.Now()
+	batch := make([]Message, 0, len(msgs))
+	//position of messages of batch in msgs.
+	positions := make([]int, 0, len(msgs))
+	ends := make([]func(error), 0, len(msgs))
+	for i, m := range msgs {
+		if m.isEmpty() {
+			errs[i] = ErrNoMessage
+			this.recordSend(dest.Name, m, errs[i])
+			continue
+		}
+		stamp(&m, now)
+		if this.tracer != nil {
+			_, end := this.tracer.StartSend(context.Background(), dest.Name, &m)
+			ends = append(ends, end)
+		}
+		batch = append(batch, m)
+		positions = append(positions, i)
+	}
+	if len(batch) == 0 {
+		return
+	}
+
+	var sent []error
+	if sender, ok := this.manager.(BatchSender); ok {
+		sent = sender.SendBatch(batch, dest)
+	} else {
+		sent = make([]error, len(batch))
+		for i, m := range batch {
+			sent[i] = this.manager.Send(m, dest)
+		}
+	}
+	for i, err := range sent {
+		if len(ends) > 0 {
+			ends[i](err)
+		}
+		errs[positions[i]] = err
+		this.recordSend(dest.Name, batch[i], err)
+	}
+}
+
+// record outcome of sending message to destination.
+func (this *Farm) recordSend(destination string, m Message, err error) {
+	this.GetInstrumentation().RecordSend(destination, m, err)
+	labels := label("destination", destination)
+	if err != nil {
+		this.metrics.inc(METRIC_SEND_ERRORS, labels)
+		return
+	}
+	this.metrics.inc(METRIC_SENT, labels)
+}
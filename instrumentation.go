@@ -0,0 +1,150 @@
+package raven
+
+import (
+	"time"
+)
+
+var _ Instrumentation = NoopInstrumentation{}
+var _ Instrumentation = multiInstrumentation{}
+
+//
+// Transaction spans processing of a single message, handed over to handler so that
+// it can record details of its own. Ended once processing completes.
+//
+type Transaction interface {
+	End() error
+	NoticeError(error) error
+	AddAttribute(key string, value interface{}) error
+}
+
+//
+// Instrumentation lets farm report to an APM or metrics backend of choice.
+// NoopInstrumentation is used when none is attached.
+//
+type Instrumentation interface {
+	//Start a transaction for a message received by msgreceiver.
+	StartMessage(receiver string, m *Message) Transaction
+
+	//Record health of a message box, at regular intervals.
+	RecordHeartBeat(receiver string, hb HeartBeat)
+
+	//Record outcome of sending a message to destination.
+	RecordSend(destination string, m Message, err error)
+
+	//Record an error that occurred outside of message processing.
+	RecordError(receiver string, err error)
+}
+
+//
+// Health of a message box, as recorded by its heartbeat.
+//
+type HeartBeat struct {
+	Box MsgBox
+
+	//Messages waiting in box to be received.
+	Inflight int
+
+	//Messages in dead box.
+	Dead int
+
+	//Time the last message received waited in box.
+	QueueWait time.Duration
+}
+
+//
+// Instrumentation that records nothing.
+//
+type NoopInstrumentation struct{}
+
+func (this NoopInstrumentation) StartMessage(string, *Message) Transaction {
+	return noopTransaction{}
+}
+
+func (this NoopInstrumentation) RecordHeartBeat(string, HeartBeat) {}
+
+func (this NoopInstrumentation) RecordSend(string, Message, error) {}
+
+func (this NoopInstrumentation) RecordError(string, error) {}
+
+type noopTransaction struct{}
+
+func (this noopTransaction) End() error { return nil }
+
+func (this noopTransaction) NoticeError(error) error { return nil }
+
+func (this noopTransaction) AddAttribute(string, interface{}) error { return nil }
+
+//
+// Combine multiple instrumentations into one, each of them records everything.
+//
+func MultiInstrumentation(instrumentations ...Instrumentation) Instrumentation {
+	return multiInstrumentation(instrumentations)
+}
+
+type multiInstrumentation []Instrumentation
+
+func (this multiInstrumentation) StartMessage(receiver string, m *Message) Transaction {
+	txns := make(multiTransaction, 0, len(this))
+	for _, i := range this {
+		txns = append(txns, i.StartMessage(receiver, m))
+	}
+	return txns
+}
+
+func (this multiInstrumentation) RecordHeartBeat(receiver string, hb HeartBeat) {
+	for _, i := range this {
+		i.RecordHeartBeat(receiver, hb)
+	}
+}
+
+func (this multiInstrumentation) RecordSend(destination string, m Message, err error) {
+	for _, i := range this {
+		i.RecordSend(destination, m, err)
+	}
+}
+
+func (this multiInstrumentation) RecordError(receiver string, err error) {
+	for _, i := range this {
+		i.RecordError(receiver, err)
+	}
+}
+
+//
+// Transactions of a multiInstrumentation, first error is returned.
+//
+type multiTransaction []Transaction
+
+func (this multiTransaction) End() error {
+	var first error
+	for _, t := range this {
+		if err := t.End(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (this multiTransaction) NoticeError(e error) error {
+	var first error
+	for _, t := range this {
+		if err := t.NoticeError(e); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Unwrap returns transactions combined, so that one of a given backend can be found.
+func (this multiTransaction) Unwrap() []Transaction {
+	return this
+}
+
+func (this multiTransaction) AddAttribute(key string, value interface{}) error {
+	var first error
+	for _, t := range this {
+		if err := t.AddAttribute(key, value); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,559 @@
+package raven
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+)
+
+//
+// Configuration to Initialize in-memory manager.
+//
+type MemoryConfig struct {
+	//Time to wait incase Q is empty, defaults to BLOCK_FOR_DURATION.
+	BlockFor time.Duration
+}
+
+//
+// An in-process Raven Manager.
+// Boxes are kept as lists within process memory and mimic the redis
+// commands used by redisbase, so receivers behave exactly the same.
+// Useful for tests and single process tools, messages do not survive restarts.
+//
+type Memory struct {
+	codecHolder
+	mutex sync.Mutex
+	boxes map[string]*list.List
+
+	//messages scheduled for future delivery, sorted by time, against box name.
+	scheduled map[string][]memoryScheduled
+
+	//visibility deadlines of messages being processed.
+	visibility visibilityTracker
+
+	//closed and replaced every time a message is pushed, wakes up blocked receivers.
+	notify chan struct{}
+
+	blockFor time.Duration
+	closed   bool
+}
+
+//
+// A message scheduled for future delivery.
+//
+type memoryScheduled struct {
+	at   time.Time
+	data string
+}
+
+func InitializeMemory(config MemoryConfig) *Memory {
+	m := new(Memory)
+	m.boxes = make(map[string]*list.List)
+	m.scheduled = make(map[string][]memoryScheduled)
+	m.notify = make(chan struct{})
+	m.blockFor = config.BlockFor
+	if m.blockFor <= 0 {
+		m.blockFor = BLOCK_FOR_DURATION
+	}
+	return m
+}
+
+//
+// List primitives, all of them expect mutex to be held.
+// Front of the list is the head (LPUSH side), Back is the tail (POP side).
+//
+
+func (this *Memory) getBox(name string) *list.List {
+	l, ok := this.boxes[name]
+	if !ok {
+		l = list.New()
+		this.boxes[name] = l
+	}
+	return l
+}
+
+func (this *Memory) wakeup() {
+	close(this.notify)
+	this.notify = make(chan struct{})
+}
+
+func (this *Memory) lpush(name string, data string) {
+	this.getBox(name).PushFront(data)
+	this.wakeup()
+}
+
+func (this *Memory) rpush(name string, data string) {
+	this.getBox(name).PushBack(data)
+	this.wakeup()
+}
+
+func (this *Memory) rpop(name string) (string, bool) {
+	l, ok := this.boxes[name]
+	if !ok || l.Len() == 0 {
+		return "", false
+	}
+	return l.Remove(l.Back()).(string), true
+}
+
+// remove entry nearest to tail, equal to receipt.
+func (this *Memory) remove(name string, receipt string) (string, bool) {
+	l, ok := this.boxes[name]
+	if !ok {
+		return "", false
+	}
+	for e := l.Back(); e != nil; e = e.Prev() {
+		if e.Value.(string) == receipt {
+			return l.Remove(e).(string), true
+		}
+	}
+	return "", false
+}
+
+func (this *Memory) llen(name string) int {
+	l, ok := this.boxes[name]
+	if !ok {
+		return 0
+	}
+	return l.Len()
+}
+
+func (this *Memory) lrange(name string) []string {
+	l, ok := this.boxes[name]
+	if !ok {
+		return nil
+	}
+	data := make([]string, 0, l.Len())
+	for e := l.Front(); e != nil; e = e.Next() {
+		data = append(data, e.Value.(string))
+	}
+	return data
+}
+
+// upto n entries from tail towards head, after skipping skip of them.
+func (this *Memory) lrangeTail(name string, skip int, n int) []string {
+	l, ok := this.boxes[name]
+	if !ok {
+		return nil
+	}
+	data := make([]string, 0, n)
+	for e := l.Back(); e != nil && len(data) < n; e = e.Prev() {
+		if skip > 0 {
+			skip--
+			continue
+		}
+		data = append(data, e.Value.(string))
+	}
+	return data
+}
+
+func (this *Memory) del(names ...string) {
+	for _, name := range names {
+		delete(this.boxes, name)
+	}
+}
+
+//
+// Pop from tail of source and, if a destination is specified, push it to head of
+// destination. Blocks till blockFor in case source is empty.
+//
+func (this *Memory) brpoplpush(source string, dest string) (string, error) {
+	deadline := time.Now().Add(this.blockFor)
+	for {
+		this.mutex.Lock()
+		if this.closed {
+			this.mutex.Unlock()
+			return "", ErrManagerClosed
+		}
+		if data, ok := this.rpop(source); ok {
+			if dest != "" {
+				this.lpush(dest, data)
+			}
+			this.mutex.Unlock()
+			return data, nil
+		}
+		wait := this.notify
+		this.mutex.Unlock()
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return "", ErrEmptyQueue
+		}
+		timer := time.NewTimer(remaining)
+		select {
+		case <-wait:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+//
+//  Implementation of Send() method exposed by raven manager.
+//
+func (this *Memory) Send(message Message, dest Destination) error {
+
+	box, err := dest.GetBox4Msg(message)
+	if err != nil {
+		return err
+	}
+	data, err := this.encodeFramed(&message)
+	if err != nil {
+		return err
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		return ErrManagerClosed
+	}
+	this.lpush(box.GetName(), data)
+	return nil
+}
+
+func (this *Memory) SendAt(message Message, dest Destination, at time.Time) error {
+
+	box, err := dest.GetBox4Msg(message)
+	if err != nil {
+		return err
+	}
+	data, err := this.encodeFramed(&message)
+	if err != nil {
+		return err
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		return ErrManagerClosed
+	}
+	this.schedule(box.GetName(), data, at)
+	return nil
+}
+
+// keep entries sorted by time, caller has to hold the lock.
+func (this *Memory) schedule(name string, data string, at time.Time) {
+	entries := this.scheduled[name]
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].at.After(at)
+	})
+	entries = append(entries, memoryScheduled{})
+	copy(entries[i+1:], entries[i:])
+	entries[i] = memoryScheduled{at: at, data: data}
+	this.scheduled[name] = entries
+}
+
+func (this *Memory) PromoteScheduled(r MsgReceiver) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	name := r.msgbox.GetName()
+	entries := this.scheduled[name]
+	now := time.Now()
+	var count int
+	for count < len(entries) && !entries[count].at.After(now) {
+		this.lpush(name, entries[count].data)
+		count++
+	}
+	this.scheduled[name] = entries[count:]
+	return count, nil
+}
+
+func (this *Memory) Receive(r MsgReceiver) (*Message, error) {
+
+	var message string
+	var err error
+	if !r.options.isReliable {
+		message, err = this.brpoplpush(r.msgbox.GetName(), "")
+	} else {
+		message, err = this.brpoplpush(r.msgbox.GetName(), r.procBox.GetName())
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m *Message = new(Message)
+	if err := this.decodeFramed(message, m); err != nil {
+		if r.options.isReliable {
+			this.mutex.Lock()
+			this.failEntry(r, message, message)
+			this.mutex.Unlock()
+		}
+		return nil, ErrUndecodable
+	}
+	if r.options.isReliable {
+		m.receipt = message
+		if timeout := r.options.visibilityTimeout; timeout > 0 {
+			this.mutex.Lock()
+			this.visibility.track(r.procBox.GetName(), message, time.Now().Add(timeout))
+			this.mutex.Unlock()
+		}
+	}
+	return m, nil
+}
+
+func (this *Memory) MarkProcessed(m *Message, r MsgReceiver) error {
+
+	if !r.options.isReliable {
+		return nil
+	}
+	receipt := receiptOf(m)
+	if receipt == "" {
+		return ErrInvalidReceipt
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.remove(r.procBox.GetName(), receipt)
+	this.visibility.untrack(r.procBox.GetName(), receipt)
+	return nil
+}
+
+func (this *Memory) MarkFailed(m *Message, r MsgReceiver) error {
+
+	if m == nil || (!r.options.isReliable) {
+		return nil //nothing to do
+	}
+	if m.receipt == "" {
+		return ErrInvalidReceipt
+	}
+	data, err := this.encodeFramed(m)
+	if err != nil {
+		return err
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.failEntry(r, m.receipt, data)
+	return nil
+}
+
+// move entry of receipt from processing box to dead box as data, mutex is held by caller.
+func (this *Memory) failEntry(r MsgReceiver, receipt string, data string) {
+	if _, ok := this.remove(r.procBox.GetName(), receipt); ok {
+		this.lpush(r.deadBox.GetName(), data)
+	}
+	this.visibility.untrack(r.procBox.GetName(), receipt)
+}
+
+//move any pending items from processingQ to sourceQ.
+func (this *Memory) PreStartup(r MsgReceiver) error {
+	if !r.options.isReliable {
+		//no processingQ specified. nothing to do
+		return nil
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for {
+		data, ok := this.rpop(r.procBox.GetName())
+		if !ok {
+			break
+		}
+		this.rpush(r.msgbox.GetName(), data)
+	}
+	this.visibility.reset(r.procBox.GetName())
+	return nil
+}
+
+func (this *Memory) ReapExpired(r MsgReceiver) (int, error) {
+	if !r.options.isReliable || r.options.visibilityTimeout <= 0 {
+		return 0, nil
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	proc := r.procBox.GetName()
+	live := this.lrange(proc)
+	expired := this.visibility.reap(proc, live, r.options.visibilityTimeout)
+	for _, receipt := range live {
+		expiries, ok := expired[receipt]
+		if !ok {
+			continue
+		}
+		this.remove(proc, receipt)
+		if r.options.maxExpiries > 0 && expiries >= r.options.maxExpiries {
+			this.lpush(r.deadBox.GetName(), this.expiredEntry(r, receipt, expiries))
+			continue
+		}
+		//new receipt, so that a late ack of expired delivery does not affect it.
+		fresh := frameEntry(unframeEntry(receipt))
+		this.visibility.carry(proc, fresh, expiries)
+		this.rpush(r.msgbox.GetName(), fresh)
+	}
+	return len(expired), nil
+}
+
+func (this *Memory) KillReceiver(r RavenReceiver) error {
+	return ErrNotImplemented
+}
+
+func (this *Memory) RequeMessage(message Message, r MsgReceiver) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if !r.options.isReliable {
+		//simply reque message
+		data, err := this.encodeFramed(&message)
+		if err != nil {
+			return err
+		}
+		this.rpush(r.msgbox.GetName(), data)
+		return nil
+	}
+	//reque and remove from processing.
+	if message.receipt == "" {
+		return ErrInvalidReceipt
+	}
+	if data, ok := this.remove(r.procBox.GetName(), message.receipt); ok {
+		this.rpush(r.msgbox.GetName(), data)
+	}
+	this.visibility.untrack(r.procBox.GetName(), message.receipt)
+	return nil
+}
+
+func (this *Memory) DelayMessage(message Message, r MsgReceiver, at time.Time) error {
+	data, err := this.encodeFramed(&message)
+	if err != nil {
+		return err
+	}
+	if r.options.isReliable && message.receipt == "" {
+		return ErrInvalidReceipt
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if r.options.isReliable {
+		this.remove(r.procBox.GetName(), message.receipt)
+		this.visibility.untrack(r.procBox.GetName(), message.receipt)
+	}
+	this.schedule(r.msgbox.GetName(), data, at)
+	return nil
+}
+
+func (this *Memory) ShowDeadQ(r MsgReceiver) ([]*Message, error) {
+	this.mutex.Lock()
+	data := this.lrange(r.deadBox.GetName())
+	this.mutex.Unlock()
+
+	msgs := make([]*Message, 0, len(data))
+	for _, v := range data {
+		m := new(Message)
+		err := this.decodeFramed(v, m)
+		if err != nil {
+			continue
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+func (this *Memory) BrowseDeadQ(r MsgReceiver, filter DeadFilter, cursor string, limit int) (DeadPage, error) {
+	if !r.options.isReliable {
+		return newDeadPage(), nil //no deadQ
+	}
+	return this.browseDeadList(filter, cursor, limit, func(skip int, n int) ([]string, error) {
+		this.mutex.Lock()
+		defer this.mutex.Unlock()
+		return this.lrangeTail(r.deadBox.GetName(), skip, n), nil
+	})
+}
+
+func (this *Memory) FlushDeadQ(r MsgReceiver) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.del(r.deadBox.GetName())
+	return nil
+}
+
+func (this *Memory) ReplayDead(r MsgReceiver, filter DeadFilter, limit int) (int, error) {
+	if !r.options.isReliable {
+		return 0, nil //no deadQ
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	entries := oldestFirst(this.lrange(r.deadBox.GetName()))
+	var replayed int
+	for _, p := range this.pickDead(entries, filter, limit) {
+		fresh, err := this.encodeFramed(p.msg)
+		if err != nil {
+			return replayed, err
+		}
+		if _, ok := this.remove(r.deadBox.GetName(), entries[p.pos]); !ok {
+			continue
+		}
+		this.lpush(r.msgbox.GetName(), fresh)
+		replayed++
+	}
+	return replayed, nil
+}
+
+func (this *Memory) DeleteDead(r MsgReceiver, filter DeadFilter, limit int) (int, error) {
+	if !r.options.isReliable {
+		return 0, nil //no deadQ
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	entries := listDeadEntries(oldestFirst(this.lrange(r.deadBox.GetName())))
+	var deleted int
+	for _, k := range this.matchDead(entries, filter, limit) {
+		if _, ok := this.remove(r.deadBox.GetName(), k); ok {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (this *Memory) ExpireDead(r MsgReceiver, retention DeadRetention) (int, error) {
+	if !r.options.isReliable {
+		return 0, nil //no deadQ
+	}
+	dead := r.deadBox.GetName()
+	return this.expireDead(retention, r.id,
+		func() (int, error) {
+			this.mutex.Lock()
+			defer this.mutex.Unlock()
+			return this.llen(dead), nil
+		},
+		listDeadEntryPages(func(skip int, n int) ([]string, error) {
+			this.mutex.Lock()
+			defer this.mutex.Unlock()
+			return this.lrangeTail(dead, skip, n), nil
+		}),
+		func(keys []string) (int, error) {
+			this.mutex.Lock()
+			defer this.mutex.Unlock()
+			removed := 0
+			for _, k := range keys {
+				if _, ok := this.remove(dead, k); ok {
+					removed++
+				}
+			}
+			return removed, nil
+		},
+	)
+}
+
+func (this *Memory) InFlightMessages(r MsgReceiver) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.llen(r.msgbox.GetName()), nil
+}
+
+func (this *Memory) GetDeadQCount(r MsgReceiver) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.llen(r.deadBox.GetName()), nil
+}
+
+func (this *Memory) FlushAll(r MsgReceiver) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.del(r.msgbox.GetName(), r.procBox.GetName(), r.deadBox.GetName())
+	delete(this.scheduled, r.msgbox.GetName())
+	this.visibility.reset(r.procBox.GetName())
+	return nil
+}
+
+//
+// Quit wakes up all blocked receivers, any further call fails with ErrManagerClosed.
+//
+func (this *Memory) Quit(r MsgReceiver) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if !this.closed {
+		this.closed = true
+		this.wakeup()
+	}
+	return nil
+}
@@ -1,8 +1,8 @@
 package raven
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"strings"
 	"time"
 
@@ -14,10 +14,35 @@ import (
 //
 const DEFAULT_MSG_TYPE = "DEF"
 
+//
+// Options that can be applied while preparing a message.
+//
+type MessageOption func(*Message)
+
+//
+// Set a header on the message.
+//
+func WithHeader(key string, value string) MessageOption {
+	return func(m *Message) {
+		m.SetHeader(key, value)
+	}
+}
+
+//
+// Set all the supplied headers on the message.
+//
+func WithHeaders(headers map[string]string) MessageOption {
+	return func(m *Message) {
+		for k, v := range headers {
+			m.SetHeader(k, v)
+		}
+	}
+}
+
 //
 // Prepare message based on the specified details.
 //
-func PrepareMessage(id string, mtype string, data string, shardKey string) Message {
+func PrepareMessage(id string, mtype string, data string, shardKey string, options ...MessageOption) Message {
 
 	if mtype == "" {
 		mtype = DEFAULT_MSG_TYPE
@@ -29,17 +54,30 @@ func PrepareMessage(id string, mtype string, data string, shardKey string) Messa
 	if shardKey == "" {
 		shardKey = id
 	}
-	return Message{
+	m := Message{
 		Id:       id,
 		ShardKey: shardKey,
 		Data:     data,
 		Type:     mtype,
 	}
+	for _, option := range options {
+		option(&m)
+	}
+	return m
+}
+
+//
+// Prepare a message carrying binary payload.
+//
+func PrepareBinaryMessage(id string, mtype string, payload []byte, shardKey string, options ...MessageOption) Message {
+	m := PrepareMessage(id, mtype, "", shardKey, options...)
+	m.Payload = payload
+	return m
 }
 
 //
 // The message that is sent and retrieved.
-// @todo: need to check if we can avoid json encoding and decoding.
+// Encoding of message is decided by the Codec of farm.
 type Message struct {
 	//Possibly Unique Id for the message.
 	Id string
@@ -53,7 +91,33 @@ type Message struct {
 	//used to decide correct message box for the message.
 	ShardKey string
 
-	mtime time.Time
+	//Metadata of the message like trace ids, tenant ids, content type.
+	Headers map[string]string `json:",omitempty"`
+
+	//Binary content of the message, used instead of Data for binary blobs.
+	Payload []byte `json:",omitempty"`
+
+	//No. of times processing of message failed temporarily and was retried.
+	Attempts int `json:",omitempty"`
+
+	//Time when message was first sent, kept as is while it is forwarded or retried.
+	//omitzero leaves it out when unset, omitempty alone never omits a struct.
+	SentAt time.Time `json:",omitempty,omitzero"`
+
+	//Time since when message is waiting in box, renewed every time it is requeued.
+	EnqueuedAt time.Time `json:",omitempty,omitzero"`
+
+	//Why processing of message failed, nil till it fails.
+	Failure *Failure `json:",omitempty"`
+
+	//Time when message was received for processing.
+	receivedAt time.Time
+
+	//Handle of this delivery, assigned by manager while receiving.
+	receipt string
+
+	//Context of the delivery, assigned by receiver while processing.
+	ctx context.Context
 }
 
 // String representation of message.
@@ -62,22 +126,86 @@ func (this Message) String() string {
 	return string(str)
 }
 
-func (this *Message) toJson() string {
-	str, err := json.Marshal(this)
-	if err != nil {
-		fmt.Println(err.Error())
+//
+// Context of the delivery being processed, cancelled when receiver is stopped
+// or the message timeout of receiver expires.
+//
+func (this *Message) Context() context.Context {
+	if this.ctx == nil {
+		return context.Background()
 	}
-	return string(str)
+	return this.ctx
 }
 
-func (this *Message) fromJson(data string) error {
-	err := json.Unmarshal([]byte(data), this)
-	return err
+//
+// Time message waited in box before being received, 0 if not known.
+//
+func (this *Message) QueueWait() time.Duration {
+	if this.EnqueuedAt.IsZero() || this.receivedAt.IsZero() || this.receivedAt.Before(this.EnqueuedAt) {
+		return 0
+	}
+	return this.receivedAt.Sub(this.EnqueuedAt)
+}
+
+//
+// Time elapsed since message was received for processing.
+//
+func (this *Message) ProcessingTime() time.Duration {
+	if this.receivedAt.IsZero() {
+		return 0
+	}
+	return time.Since(this.receivedAt)
+}
+
+//
+// Time elapsed since message was first sent, 0 if not known.
+//
+func (this *Message) Age() time.Duration {
+	if this.SentAt.IsZero() {
+		return 0
+	}
+	return time.Since(this.SentAt)
+}
+
+//
+// Content of the message as bytes, irrespective of it being sent as Data or Payload.
+//
+func (this *Message) Bytes() []byte {
+	if len(this.Payload) > 0 {
+		return this.Payload
+	}
+	return []byte(this.Data)
+}
+
+//
+// Set a header on the message.
+//
+func (this *Message) SetHeader(key string, value string) *Message {
+	if this.Headers == nil {
+		this.Headers = make(map[string]string)
+	}
+	this.Headers[key] = value
+	return this
+}
+
+//
+// Get value of a header, empty if not set.
+//
+func (this *Message) GetHeader(key string) string {
+	return this.Headers[key]
+}
+
+// receipt of a possibly nil message.
+func receiptOf(m *Message) string {
+	if m == nil {
+		return ""
+	}
+	return m.receipt
 }
 
 //Check if its an empty message.
 func (this *Message) isEmpty() bool {
-	if this.Data == "" {
+	if this.Data == "" && len(this.Payload) == 0 {
 		return true
 	}
 	return false
@@ -0,0 +1,236 @@
+package raven
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Upper bounds, in seconds, of buckets of handler latency histogram.
+//
+var LATENCY_BUCKETS = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+//
+// Upper bounds, in seconds, of buckets of queue wait histogram.
+//
+var QUEUE_WAIT_BUCKETS = []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
+//
+// Names of metrics exposed in prometheus text format.
+//
+const (
+	METRIC_SENT             = "raven_messages_sent_total"
+	METRIC_SEND_ERRORS      = "raven_send_errors_total"
+	METRIC_PROCESSED        = "raven_messages_processed_total"
+	METRIC_FAILED           = "raven_messages_failed_total"
+	METRIC_REQUEUED         = "raven_messages_requeued_total"
+	METRIC_DEAD_EXPIRED     = "raven_dead_expired_total"
+	METRIC_RECEIVE_ERRORS   = "raven_receive_errors_total"
+	METRIC_HANDLER_DURATION = "raven_handler_duration_seconds"
+	METRIC_QUEUE_WAIT       = "raven_queue_wait_seconds"
+	METRIC_QUEUE_LAG        = "raven_queue_lag_seconds"
+	METRIC_INFLIGHT         = "raven_inflight_messages"
+	METRIC_DEAD             = "raven_dead_messages"
+	METRIC_BOX_ACTIVE       = "raven_box_active"
+	METRIC_LOCK_HELD        = "raven_receiver_lock_held"
+)
+
+var metricHelp = map[string]string{
+	METRIC_SENT:             "Messages sent, by destination.",
+	METRIC_SEND_ERRORS:      "Messages that could not be sent, by destination.",
+	METRIC_PROCESSED:        "Messages processed successfully, by box.",
+	METRIC_FAILED:           "Messages moved to dead box, by box.",
+	METRIC_REQUEUED:         "Messages requeued for retry after a temporary failure, by box.",
+	METRIC_DEAD_EXPIRED:     "Dead messages removed on exceeding retention, by box.",
+	METRIC_RECEIVE_ERRORS:   "Errors while receiving messages, by box.",
+	METRIC_HANDLER_DURATION: "Time taken by handler to process a message, by box.",
+	METRIC_QUEUE_WAIT:       "Time messages waited in box before being received, by box.",
+	METRIC_QUEUE_LAG:        "Time the last message received waited in box.",
+	METRIC_INFLIGHT:         "Messages waiting in box to be received.",
+	METRIC_DEAD:             "Messages in dead box.",
+	METRIC_BOX_ACTIVE:       "Whether messages of box are being received by this process.",
+	METRIC_LOCK_HELD:        "Whether receiver holds the lock of its source.",
+}
+
+//
+// Counters and histograms of a farm, shared by its ravens and receivers.
+//
+type metrics struct {
+	mutex sync.Mutex
+	//against metric name and rendered labels.
+	counters   map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		counters:   make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+	}
+}
+
+func (this *metrics) inc(name string, labels string) {
+	this.add(name, labels, 1)
+}
+
+func (this *metrics) add(name string, labels string, n int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	series, ok := this.counters[name]
+	if !ok {
+		series = make(map[string]float64)
+		this.counters[name] = series
+	}
+	series[labels] += float64(n)
+}
+
+func (this *metrics) observe(name string, labels string, buckets []float64, d time.Duration) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	series, ok := this.histograms[name]
+	if !ok {
+		series = make(map[string]*histogram)
+		this.histograms[name] = series
+	}
+	h, ok := series[labels]
+	if !ok {
+		h = &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+		series[labels] = h
+	}
+	v := d.Seconds()
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+//
+// Write all the counters and histograms in prometheus text format.
+//
+func (this *metrics) write(w io.Writer) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	names := make([]string, 0, len(this.counters))
+	for name := range this.counters {
+		names = append(names, name)
+	}
+	for _, name := range sortStrings(names) {
+		writeMetric(w, name, "counter", this.counters[name])
+	}
+
+	names = names[:0]
+	for name := range this.histograms {
+		names = append(names, name)
+	}
+	for _, name := range sortStrings(names) {
+		writeHeader(w, name, "histogram")
+		series := this.histograms[name]
+		keys := make([]string, 0, len(series))
+		for labels := range series {
+			keys = append(keys, labels)
+		}
+		for _, labels := range sortStrings(keys) {
+			h := series[labels]
+			var cumulative uint64
+			for i, le := range h.buckets {
+				cumulative += h.counts[i]
+				writeSample(w, name+"_bucket", joinLabels(labels, label("le", formatFloat(le))), float64(cumulative))
+			}
+			writeSample(w, name+"_bucket", joinLabels(labels, label("le", "+Inf")), float64(h.count))
+			writeSample(w, name+"_sum", labels, h.sum)
+			if _, err := fmt.Fprintf(w, "%s_count%s %d\n", name, wrapLabels(labels), h.count); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//
+// Write samples of a metric, of the given type, in prometheus text format.
+//
+func writeMetric(w io.Writer, name string, mtype string, samples map[string]float64) {
+	if len(samples) == 0 {
+		return
+	}
+	writeHeader(w, name, mtype)
+	keys := make([]string, 0, len(samples))
+	for labels := range samples {
+		keys = append(keys, labels)
+	}
+	for _, labels := range sortStrings(keys) {
+		writeSample(w, name, labels, samples[labels])
+	}
+}
+
+func writeHeader(w io.Writer, name string, mtype string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, metricHelp[name], name, mtype)
+}
+
+func writeSample(w io.Writer, name string, labels string, v float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, wrapLabels(labels), formatFloat(v))
+}
+
+// render a label pair, escaping value.
+func label(key string, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return fmt.Sprintf(`%s="%s"`, key, value)
+}
+
+func joinLabels(a string, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func wrapLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortStrings(keys []string) []string {
+	sort.Strings(keys)
+	return keys
+}
+
+//
+// Serves metrics of farm in prometheus text format, for producers
+// that do not run a receiver.
+//
+func (this *Farm) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		this.WriteMetrics(w)
+	})
+}
+
+//
+// Write counters of farm in prometheus text format.
+//
+func (this *Farm) WriteMetrics(w io.Writer) error {
+	return this.metrics.write(w)
+}
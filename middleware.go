@@ -0,0 +1,90 @@
+package raven
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+//
+// Middleware wraps a MessageHandler, adding behaviour before and/or after it.
+//
+type Middleware func(MessageHandler) MessageHandler
+
+//
+// Wrap handler with middlewares, the first middleware being the outermost.
+//
+func chainMiddlewares(f MessageHandler, middlewares []Middleware) MessageHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		f = middlewares[i](f)
+	}
+	return f
+}
+
+//
+// Logs outcome of every message alongwith the time taken to process it.
+//
+func LoggingMiddleware(logger Logger) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(m *Message, txn Transaction) error {
+			start := time.Now()
+			err := next(m, txn)
+			took := time.Since(start)
+			switch err {
+			case nil:
+				logger.Info(m.Id, fmt.Sprintf("Processed message of type [%s] in %s", m.Type, took))
+			case ErrTmpFailure:
+				logger.Warning(m.Id, fmt.Sprintf("Temporary failure for message of type [%s] in %s", m.Type, took))
+			default:
+				logger.Error(m.Id, fmt.Sprintf("Failed message of type [%s] in %s, Error: %s", m.Type, took, err.Error()))
+			}
+			return err
+		}
+	}
+}
+
+//
+// Bounds processing of a message by timeout, through the context of message.
+// Handlers are expected to give up once m.Context() is done, messages whose
+// handler fails after timeout are failed with ErrTmpFailure, so they are retried.
+//
+func TimeoutMiddleware(timeout time.Duration) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(m *Message, txn Transaction) error {
+			parent := m.ctx
+			ctx, cancel := context.WithTimeout(m.Context(), timeout)
+			defer func() {
+				cancel()
+				m.ctx = parent
+			}()
+			m.ctx = ctx
+			err := next(m, txn)
+			if err != nil && ctx.Err() == context.DeadlineExceeded {
+				return ErrTmpFailure
+			}
+			return err
+		}
+	}
+}
+
+//
+// Converts panics in handler to errors, failing the message permanently.
+//
+func RecoverMiddleware() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(m *Message, txn Transaction) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = panicError(m, r)
+				}
+			}()
+			return next(m, txn)
+		}
+	}
+}
+
+func panicError(m *Message, r interface{}) error {
+	return fmt.Errorf("Panic Occurred !!! Handled Gracefully \n Message: %s, Stack: %s", m, errors.Wrap(r, 5).ErrorStack())
+}
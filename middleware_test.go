@@ -0,0 +1,117 @@
+package raven
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// middleware recording calls before and after next in calls.
+func recordingMiddleware(name string, calls *[]string) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(m *Message, txn Transaction) error {
+			*calls = append(*calls, name+" before")
+			err := next(m, txn)
+			*calls = append(*calls, name+" after")
+			return err
+		}
+	}
+}
+
+func TestChainMiddlewaresOrder(t *testing.T) {
+	var calls []string
+	f := chainMiddlewares(func(m *Message, txn Transaction) error {
+		calls = append(calls, "handler")
+		return nil
+	}, []Middleware{recordingMiddleware("first", &calls), recordingMiddleware("second", &calls)})
+
+	if err := f(&Message{}, nil); err != nil {
+		t.Fatalf("handler failed: %s", err)
+	}
+	want := []string{"first before", "second before", "handler", "second after", "first after"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestChainMiddlewaresEmpty(t *testing.T) {
+	f := chainMiddlewares(func(m *Message, txn Transaction) error {
+		return errHandled
+	}, nil)
+	if err := f(&Message{}, nil); err != errHandled {
+		t.Errorf("handler error = %v, want %v", err, errHandled)
+	}
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	f := RecoverMiddleware()(func(m *Message, txn Transaction) error {
+		panic("boom")
+	})
+	err := f(&Message{Id: "m1"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "Panic") || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("error = %v, want panic error", err)
+	}
+
+	f = RecoverMiddleware()(func(m *Message, txn Transaction) error {
+		return errHandled
+	})
+	if err := f(&Message{}, nil); err != errHandled {
+		t.Errorf("error = %v, want %v", err, errHandled)
+	}
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	cases := []struct {
+		name    string
+		handler MessageHandler
+		want    error
+	}{
+		{"finished in time", func(m *Message, txn Transaction) error {
+			return nil
+		}, nil},
+		{"failed in time", func(m *Message, txn Transaction) error {
+			return errHandled
+		}, errHandled},
+		{"cancelled on timeout", func(m *Message, txn Transaction) error {
+			<-m.Context().Done()
+			return m.Context().Err()
+		}, ErrTmpFailure},
+		{"done despite timeout", func(m *Message, txn Transaction) error {
+			<-m.Context().Done()
+			return nil
+		}, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			parent, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			m := &Message{ctx: parent}
+			start := time.Now()
+			err := TimeoutMiddleware(20*time.Millisecond)(c.handler)(m, nil)
+			if err != c.want {
+				t.Errorf("error = %v, want %v", err, c.want)
+			}
+			if took := time.Since(start); took > time.Second {
+				t.Errorf("took %s, handler not cancelled", took)
+			}
+			if m.Context() != parent {
+				t.Errorf("context of message not restored")
+			}
+		})
+	}
+}
+
+func TestTimeoutMiddlewareKeepsParentCancellation(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	m := &Message{ctx: parent}
+	f := TimeoutMiddleware(time.Minute)(func(m *Message, txn Transaction) error {
+		cancel()
+		<-m.Context().Done()
+		return m.Context().Err()
+	})
+	if err := f(m, nil); err != context.Canceled {
+		t.Errorf("error = %v, want %v", err, context.Canceled)
+	}
+}
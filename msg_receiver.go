@@ -1,11 +1,11 @@
 package raven
 
 import (
+	"context"
 	"fmt"
+	"sync/atomic"
 	"time"
 
-	"github.com/go-errors/errors"
-	newrelic "github.com/newrelic/go-agent"
 	"github.com/sanksons/gowraps/util"
 )
 
@@ -29,6 +29,14 @@ type MsgReceiver struct {
 		//Specifies if we want to use reliable Q or not
 		//@todo: ordering is yet to be implemented.
 		isReliable, ordering bool
+
+		//Messages being processed for longer than this are returned to box,
+		//0 disables it.
+		visibilityTimeout time.Duration
+
+		//No. of times visibility of a message can expire before moving it to dead box,
+		//0 means never.
+		maxExpiries int
 	}
 
 	//Q to store processing and dead messages.
@@ -37,8 +45,27 @@ type MsgReceiver struct {
 	deadBox MsgBox
 
 	// Flags required to handle proper shutdown of msgreceivers.
-	stopFlag bool
-	stopped  chan bool
+	stopped chan bool
+
+	//Shared with copies of msgreceiver handed over to managers.
+	state *receiverState
+
+	//closed on stop, to shutdown workers, scheduler, reaper and janitor of a run.
+	quit chan struct{}
+
+	//Parent context of messages of a run, cancelled on stop.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+//
+// State of a msgreceiver read by metrics and group while it runs, accessed atomically.
+//
+type receiverState struct {
+	running int32
+
+	//Time last message received waited in box.
+	queueWait int64
 }
 
 func (this MsgReceiver) String() string {
@@ -65,33 +92,27 @@ func (this *MsgReceiver) log(ltype string, msg string) {
 }
 
 //
-// setId defines identifier for msgreceiver.
+// Get identifier for the msgreceiver.
 //
-func (this *MsgReceiver) setId(id string) *MsgReceiver {
-	// Since a message box can have only one receiver, it makes sense to allot
-	// msgBox name as Id.
-	this.id = this.msgbox.GetName()
-	return this
+func (this *MsgReceiver) GetId() string {
+	return this.id
 }
 
 //
-// getNewrelicTransaction fetches newrelic.Transaction object
+// Get the message box this receiver receives from.
 //
-func (this *MsgReceiver) getNewrelicTransaction() newrelic.Transaction {
-	if this.parent.farm.newrelicApp != nil {
-		return this.parent.farm.newrelicApp.StartTransaction(this.id, nil, nil)
-	}
-	return nil
+func (this *MsgReceiver) GetMsgBox() MsgBox {
+	return this.msgbox
 }
 
 //
-// endNewrelicTransaction ends existing newrelic transaction
+// setId defines identifier for msgreceiver.
 //
-func (this *MsgReceiver) endNewrelicTransaction(txn newrelic.Transaction) {
-	if txn == nil {
-		return
-	}
-	txn.End()
+func (this *MsgReceiver) setId(id string) *MsgReceiver {
+	// Since a message box can have only one receiver, it makes sense to allot
+	// msgBox name as Id.
+	this.id = this.msgbox.GetName()
+	return this
 }
 
 //
@@ -99,24 +120,16 @@ func (this *MsgReceiver) endNewrelicTransaction(txn newrelic.Transaction) {
 //
 func (this *MsgReceiver) recordHeartBeat(inflightCount int, deadCount int) {
 
-	if this.parent.farm.newrelicApp == nil {
-		return
+	hb := HeartBeat{
+		Box:       this.msgbox,
+		Inflight:  inflightCount,
+		Dead:      deadCount,
+		QueueWait: this.GetQueueWait(),
 	}
-	//Record Heart Beat
-	heartbeatName := "RavenHeartBeat"
-
-	this.parent.farm.newrelicApp.RecordCustomEvent(
-		heartbeatName, map[string]interface{}{
-			"inflightcount": inflightCount,
-			"checkedAt":     int(time.Now().Unix()),
-			"queue":         this.msgbox.GetRawName(),
-			"box":           this.msgbox.GetBoxId(),
-			"deadCount":     deadCount,
-		},
-	)
+	this.parent.farm.GetInstrumentation().RecordHeartBeat(this.id, hb)
 
 	this.getLogger().Info(this.msgbox.GetName(), this.id, "HeartBeat",
-		fmt.Sprintf("In Flight Ravens: %d", inflightCount),
+		fmt.Sprintf("In Flight Ravens: %d, Queue Wait: %s", inflightCount, hb.QueueWait),
 	)
 }
 
@@ -191,6 +204,102 @@ func (this *MsgReceiver) startHeartBeat() {
 	}
 }
 
+//
+// Start Scheduler of Receiver, moves scheduled messages into msgbox once due.
+//
+func (this *MsgReceiver) startScheduler(quit <-chan struct{}) {
+	for {
+		select {
+		case <-quit:
+			return
+		case <-time.After(SCHEDULE_POLL_INTERVAL):
+		}
+		func() {
+			// Incase of panic, restart for loop.
+			defer util.PanicHandler(fmt.Sprintf("Scheduler: %s", this.id))
+
+			n, err := this.parent.farm.manager.PromoteScheduled(*this)
+			if err != nil {
+				this.getLogger().Error(this.msgbox.GetName(), this.id, "Scheduler",
+					fmt.Sprintf("Error: %s", err.Error()),
+				)
+				return
+			}
+			if n > 0 {
+				this.log("info", fmt.Sprintf("Moved %d scheduled messages to box", n))
+			}
+		}()
+	}
+}
+
+//
+// Start Reaper of Receiver, returns messages whose visibility timeout expired.
+//
+func (this *MsgReceiver) startReaper(quit <-chan struct{}) {
+	if !this.options.isReliable || this.options.visibilityTimeout <= 0 {
+		return
+	}
+	interval := VISIBILITY_REAP_INTERVAL
+	if this.options.visibilityTimeout < interval {
+		interval = this.options.visibilityTimeout
+	}
+	for {
+		select {
+		case <-quit:
+			return
+		case <-time.After(interval):
+		}
+		func() {
+			// Incase of panic, restart for loop.
+			defer util.PanicHandler(fmt.Sprintf("Reaper: %s", this.id))
+
+			n, err := this.parent.farm.manager.ReapExpired(*this)
+			if err != nil {
+				this.getLogger().Error(this.msgbox.GetName(), this.id, "Reaper",
+					fmt.Sprintf("Error: %s", err.Error()),
+				)
+				return
+			}
+			if n > 0 {
+				this.log("warning", fmt.Sprintf("Returned %d messages with expired visibility timeout", n))
+			}
+		}()
+	}
+}
+
+//
+// Start Janitor of Receiver, removes dead messages exceeding retention of parent.
+//
+func (this *MsgReceiver) startJanitor(quit <-chan struct{}) {
+	retention := this.parent.deadRetention
+	if !this.options.isReliable || !retention.enabled() {
+		return
+	}
+	for {
+		select {
+		case <-quit:
+			return
+		case <-time.After(retention.interval()):
+		}
+		func() {
+			// Incase of panic, restart for loop.
+			defer util.PanicHandler(fmt.Sprintf("Janitor: %s", this.id))
+
+			n, err := this.parent.farm.manager.ExpireDead(*this, retention)
+			if n > 0 {
+				this.parent.farm.metrics.add(METRIC_DEAD_EXPIRED, this.metricLabels(), n)
+				this.log("info", fmt.Sprintf("Removed %d dead messages exceeding retention", n))
+			}
+			if err != nil {
+				this.parent.farm.GetInstrumentation().RecordError(this.id, err)
+				this.getLogger().Error(this.msgbox.GetName(), this.id, "Janitor",
+					fmt.Sprintf("Error: %s", err.Error()),
+				)
+			}
+		}()
+	}
+}
+
 // ANy validations required for msgreceiver goes here.
 func (this *MsgReceiver) validate() error {
 	//@todo: implement all the necessary validations required for receiver.
@@ -201,11 +310,32 @@ func (this *MsgReceiver) validate() error {
 // stop shutdown the msgreceiver
 //
 func (this *MsgReceiver) stop() {
-	this.stopFlag = true
-	<-this.stopped
+	if !this.isRunning() {
+		return
+	}
+	defer this.setRunning(false)
+	close(this.quit)
+	this.cancel()
+	//wait for all the workers to stop.
+	for i := 0; i < this.parent.getConcurrency(); i++ {
+		<-this.stopped
+	}
 	return
 }
 
+// check if msgreceiver is running.
+func (this *MsgReceiver) isRunning() bool {
+	return atomic.LoadInt32(&this.state.running) == 1
+}
+
+func (this *MsgReceiver) setRunning(running bool) {
+	var v int32
+	if running {
+		v = 1
+	}
+	atomic.StoreInt32(&this.state.running, v)
+}
+
 //
 // This Hook is called before starting the receiver, to ensure that receiver
 // meets all the pre stated conditions and will not fail to bootup.
@@ -224,19 +354,49 @@ func (this *MsgReceiver) preStart() error {
 }
 
 //
-// start starts up the message receiver.
+// run starts up the message receiver alongwith its scheduler, reaper and janitor,
+// without blocking.
+//
+func (this *MsgReceiver) run(f MessageHandler) {
+	this.setRunning(true)
+	this.quit = make(chan struct{})
+	this.ctx, this.cancel = context.WithCancel(context.Background())
+	go this.startScheduler(this.quit)
+	go this.startReaper(this.quit)
+	go this.startJanitor(this.quit)
+	go this.start(chainMiddlewares(f, this.parent.middlewares))
+}
+
+//
+// start starts up the message receiver, with as many workers as the
+// concurrency of parent.
 //
 func (this *MsgReceiver) start(f MessageHandler) {
 
-	this.log("info", fmt.Sprintf("Starting Raven receiver with config, %s", this))
+	concurrency := this.parent.getConcurrency()
+	this.log("info", fmt.Sprintf("Starting Raven receiver with %d workers and config, %s", concurrency, this))
+	for i := 1; i < concurrency; i++ {
+		go this.work(f)
+	}
+	// this blocks
+	this.work(f)
+}
+
+//
+// work receives and processes messages one at a time, till receiver is stopped.
+//
+func (this *MsgReceiver) work(f MessageHandler) {
+
 	receiver := *this
 
 	// this blocks
 	for {
-		if this.stopFlag {
+		select {
+		case <-this.quit:
 			fmt.Printf("\nStopped MsgReceiver: %s", this.id)
 			this.stopped <- true
 			return
+		default:
 		}
 		//this blocks, so no need for wait on empty Q.
 		msg, err := this.parent.farm.manager.Receive(receiver)
@@ -248,46 +408,62 @@ func (this *MsgReceiver) start(f MessageHandler) {
 			continue
 		}
 
-		// Case 2: Something went wrong, May be server is not reachable.
+		// Case 2: Message could not be decoded, it is moved to dead box incase
+		// receiver is reliable. Move on to next one.
+		if err == ErrUndecodable {
+			this.log("error", "Got a message that could not be decoded, check codec of senders.")
+			this.parent.farm.GetInstrumentation().RecordError(this.id, err)
+			this.parent.farm.metrics.inc(METRIC_RECEIVE_ERRORS, this.metricLabels())
+			continue
+		}
+
+		// Case 3: Something went wrong, May be server is not reachable.
 		// Log, Sleep and retry.
 		if err != nil {
 			//log error
 			this.log("error", fmt.Sprintf("Got Error while receiving. Error: %s", err.Error()))
+			this.parent.farm.GetInstrumentation().RecordError(this.id, err)
+			this.parent.farm.metrics.inc(METRIC_RECEIVE_ERRORS, this.metricLabels())
 			this.log("info", "Waiting for 5 seconds before retrying.")
 			time.Sleep(5 * time.Second)
 			continue
 		}
 
-		//Case 3: All went well and a Message is retrieved.
+		//Case 4: All went well and a Message is retrieved.
 		// process message and retry.
 		// - If success, MarkAsProcessed.
-		// - If failed with TmpErr, Reque for reprocessing.
+		// - If failed with TmpErr, Retry after a backoff, till attempts run out.
 		// - If failed with Permanent error, store in DeadBox.
-		this.log("info", fmt.Sprintf("Received Message: %s", msg))
+		msg.receivedAt = time.Now()
+		this.recordQueueWait(msg)
+		this.log("info", fmt.Sprintf("Received Message: %s, waited %s in box", msg, msg.QueueWait()))
 
 		//
 		// Send Message for processing.
 		//
+		ctx, cancel := this.messageContext()
+		msg.ctx = ctx
 		execerr := this.processMessage(msg, f)
+		this.log("info", fmt.Sprintf("Message [%s] took %s to process", msg.Id, msg.ProcessingTime()))
+		if execerr != nil {
+			msg.recordFailure(execerr)
+		}
+		// Handlers cut short by stop or timeout are retried.
+		if execerr != nil && ctx.Err() != nil {
+			execerr = ErrTmpFailure
+		}
+		cancel()
+		this.parent.stats.record(msg.Type, execerr)
 
 		if execerr == nil { // Mark as Processed.
 			if err := this.markProcessed(msg); err != nil {
+				this.parent.farm.GetInstrumentation().RecordError(this.id, err)
 				this.log("error",
 					fmt.Sprintf("Could Not mark message as processed. Error: %s, Message: %s", err.Error(), msg),
 				)
 			}
-		} else if execerr == ErrTmpFailure { // Requeue Message.
-			//@todo: need to check if there should be a limit for requing message.
-			// else it might stuck in a never ending loop, if client is sending incorrect error.
-			this.log("error", fmt.Sprintf("Got temporary error while processing. message [%s], requeing it", msg))
-			if err := this.requeueMessage(*msg); err != nil {
-				this.log("error",
-					fmt.Sprintf("Could Not Reque message. Error: %s, Message: %s", err.Error(), msg),
-				)
-			}
-			//sleep till 3 seconds, before repulling message.
-			time.Sleep(3 * time.Second)
-
+		} else if execerr == ErrTmpFailure { // Retry Message, as per retry policy.
+			this.retryMessage(msg)
 		} else { // Store in DeadBox
 			// Found a permanent error while processing message.
 			this.log("error", fmt.Sprintf(
@@ -301,29 +477,75 @@ func (this *MsgReceiver) start(f MessageHandler) {
 	}
 }
 
+//
+// Retry a message that failed temporarily, after a backoff.
+// Message is moved to deadbox once it runs out of attempts.
+//
+func (this *MsgReceiver) retryMessage(msg *Message) {
+	policy := this.parent.retryPolicy
+	if policy.exhausted(msg.Attempts + 1) {
+		this.log("error", fmt.Sprintf(
+			"Got temporary error while processing Message: %s, no attempts left, Discarding it", msg,
+		))
+		if err := this.markFailed(msg); err != nil {
+			this.log("error", fmt.Sprintf("Could Not mark message as dead. Error: %s, Message : %s", err.Error(), msg))
+		}
+		return
+	}
+	delay := policy.delay(msg.Attempts)
+	msg.Attempts++
+	this.log("error", fmt.Sprintf(
+		"Got temporary error while processing. message [%s], retrying it after %s", msg, delay,
+	))
+	if err := this.delayMessage(*msg, delay); err != nil {
+		this.log("error",
+			fmt.Sprintf("Could Not Reque message. Error: %s, Message: %s", err.Error(), msg),
+		)
+		return
+	}
+	this.parent.farm.metrics.inc(METRIC_REQUEUED, this.metricLabels())
+}
+
+//
+// Context for processing a message, bounded by message timeout of parent.
+//
+func (this *MsgReceiver) messageContext() (context.Context, context.CancelFunc) {
+	if timeout := this.parent.messageTimeout; timeout > 0 {
+		return context.WithTimeout(this.ctx, timeout)
+	}
+	return context.WithCancel(this.ctx)
+}
+
 //
 // Upon receiving the message its passed on to this method for processing.
 //
 func (this *MsgReceiver) processMessage(msg *Message, f MessageHandler) error {
 	var execerr error
-	var txn newrelic.Transaction
+	if tracer := this.parent.farm.tracer; tracer != nil {
+		ctx, end := tracer.StartProcess(msg.Context(), this.msgbox, msg)
+		msg.ctx = ctx
+		defer func() { end(execerr) }()
+	}
+	txn := this.parent.farm.GetInstrumentation().StartMessage(this.id, msg)
+	start := time.Now()
 	func() {
 		// handle any panics occuring from client code.
 		defer func() {
 			if r := recover(); r != nil {
-				emsg := fmt.Sprintf("Panic Occurred !!! Handled Gracefully \n Message: %s, Stack: %s", msg, errors.Wrap(r, 5).ErrorStack())
-				execerr = fmt.Errorf(emsg)
+				execerr = panicError(msg, r)
 			}
-			// Check if transaction is started and needs to be wrapped up.
-			//this.endNewrelicTransaction(txn)
 		}()
 
 		// Send Message for processing.
-		// Note: pass newrelic transaction alongside so that client can
+		// Note: pass transaction alongside so that client can
 		// make use of it and record segments.
-		//txn = this.getNewrelicTransaction()
 		execerr = f(msg, txn)
 	}()
+	this.parent.farm.metrics.observe(METRIC_HANDLER_DURATION, this.metricLabels(), LATENCY_BUCKETS, time.Since(start))
+	if execerr != nil {
+		txn.NoticeError(execerr)
+	}
+	txn.End()
 	return execerr
 }
 
@@ -334,6 +556,13 @@ func (this *MsgReceiver) showDeadBox() ([]*Message, error) {
 	return this.parent.farm.manager.ShowDeadQ(*this)
 }
 
+//
+// List a page of messages from deadBox.
+//
+func (this *MsgReceiver) browseDeadBox(filter DeadFilter, cursor string, limit int) (DeadPage, error) {
+	return this.parent.farm.manager.BrowseDeadQ(*this, filter, cursor, limit)
+}
+
 //
 // Get Count of messages residing in dead box.
 //
@@ -348,6 +577,28 @@ func (this *MsgReceiver) flushDeadBox() error {
 	return this.parent.farm.manager.FlushDeadQ(*this)
 }
 
+//
+// Move dead messages matching filter back to box.
+//
+func (this *MsgReceiver) replayDeadBox(filter DeadFilter, limit int) (int, error) {
+	n, err := this.parent.farm.manager.ReplayDead(*this, filter, limit)
+	if n > 0 {
+		this.log("info", fmt.Sprintf("Replayed %d dead messages", n))
+	}
+	return n, err
+}
+
+//
+// Delete dead messages matching filter.
+//
+func (this *MsgReceiver) deleteDead(filter DeadFilter, limit int) (int, error) {
+	n, err := this.parent.farm.manager.DeleteDead(*this, filter, limit)
+	if n > 0 {
+		this.log("info", fmt.Sprintf("Deleted %d dead messages", n))
+	}
+	return n, err
+}
+
 //
 // Flush All messages
 //
@@ -359,42 +610,61 @@ func (this *MsgReceiver) flushAll() error {
 // Mark Message as processed.
 //
 func (this *MsgReceiver) markProcessed(msg *Message) error {
-	// this.parent.farm.newrelicApp.RecordCustomEvent(
-	// 	"RavenMessage", map[string]interface{}{
-	// 		"processedAt": int(time.Now().Unix()),
-	// 		"queue":       this.msgbox.GetRawName(),
-	// 		"box":         this.msgbox.GetBoxId(),
-	// 		"msgId":       msg.Id,
-	// 		"type":        msg.Type,
-	// 		"data":        msg.Data,
-	// 		"status":      "processed",
-	// 	},
-	// )
-	return this.parent.farm.manager.MarkProcessed(msg, *this)
+	if err := this.parent.farm.manager.MarkProcessed(msg, *this); err != nil {
+		return err
+	}
+	this.parent.farm.metrics.inc(METRIC_PROCESSED, this.metricLabels())
+	return nil
 }
 
 //
 // Requeue message incase of tmp error.
 //
 func (this *MsgReceiver) requeueMessage(msg Message) error {
+	msg.EnqueuedAt = time.Now()
 	return this.parent.farm.manager.RequeMessage(msg, *this)
 }
 
 //
-// Mark message as failed.
+// Requeue message to be received again after the specified delay.
+//
+func (this *MsgReceiver) delayMessage(msg Message, d time.Duration) error {
+	msg.EnqueuedAt = time.Now().Add(d)
+	return this.parent.farm.manager.DelayMessage(msg, *this, msg.EnqueuedAt)
+}
+
+//
+// Record time message waited in box, messages sent without a timestamp are skipped.
+//
+func (this *MsgReceiver) recordQueueWait(msg *Message) {
+	if msg.SentAt.IsZero() || msg.EnqueuedAt.IsZero() {
+		return
+	}
+	wait := msg.QueueWait()
+	atomic.StoreInt64(&this.state.queueWait, int64(wait))
+	this.parent.farm.metrics.observe(METRIC_QUEUE_WAIT, this.metricLabels(), QUEUE_WAIT_BUCKETS, wait)
+}
+
+//
+// Time the last message received waited in box.
+//
+func (this *MsgReceiver) GetQueueWait() time.Duration {
+	return time.Duration(atomic.LoadInt64(&this.state.queueWait))
+}
+
+//
+// Mark message as failed, moving it to dead box alongwith its failure.
 //
 func (this *MsgReceiver) markFailed(msg *Message) error {
+	msg.recordDeath(this)
+	if err := this.parent.farm.manager.MarkFailed(msg, *this); err != nil {
+		return err
+	}
+	this.parent.farm.metrics.inc(METRIC_FAILED, this.metricLabels())
+	return nil
+}
 
-	// this.parent.farm.newrelicApp.RecordCustomEvent(
-	// 	"RavenMessage", map[string]interface{}{
-	// 		"processedAt": int(time.Now().Unix()),
-	// 		"queue":       this.msgbox.GetRawName(),
-	// 		"box":         this.msgbox.GetBoxId(),
-	// 		"msgId":       msg.Id,
-	// 		"type":        msg.Type,
-	// 		"data":        msg.Data,
-	// 		"status":      "dead",
-	// 	},
-	// )
-	return this.parent.farm.manager.MarkFailed(msg, *this)
+// labels identifying msgreceiver in metrics.
+func (this *MsgReceiver) metricLabels() string {
+	return joinLabels(label("receiver", this.parent.GetId()), label("box", this.id))
 }
@@ -0,0 +1,135 @@
+package raven
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testMsgType = "job"
+
+// start the only message receiver of a memory backed receiver with f, after sending it a message.
+func startMemoryReceiver(t *testing.T, timeout time.Duration, f MessageHandler) *MsgReceiver {
+	farm, err := InitializeFarm(FARM_TYPE_MEMORY, MemoryConfig{BlockFor: 10 * time.Millisecond}, nil)
+	if err != nil {
+		t.Fatalf("Could not initialize farm: %s", err)
+	}
+	receiver, err := farm.GetRavenReceiver("jobs-receiver", CreateSource("jobs", 1))
+	if err != nil {
+		t.Fatalf("Could not create receiver: %s", err)
+	}
+	receiver.SetMessageTimeout(timeout)
+
+	m := PrepareMessage("m1", testMsgType, "data", "")
+	if err := farm.GetRaven().HandMessage(m).SetDestination(CreateDestination("jobs", 1, nil)).Fly(); err != nil {
+		t.Fatalf("Could not send message: %s", err)
+	}
+	r := receiver.msgReceivers[0]
+	if err := r.preStart(); err != nil {
+		t.Fatalf("Could not start receiver: %s", err)
+	}
+	r.run(f)
+	return r
+}
+
+// wait till message is handled and return its stats.
+func waitForStats(t *testing.T, r *MsgReceiver) TypeStats {
+	var stats TypeStats
+	waitFor(t, "message to be handled", func() bool {
+		stats = r.parent.stats.snapshot()[testMsgType]
+		return stats.Received == 1
+	})
+	return stats
+}
+
+func TestReceiverStopCancelsHandler(t *testing.T) {
+	started := make(chan bool, 1)
+	errs := make(chan error, 1)
+	r := startMemoryReceiver(t, 0, func(m *Message, txn Transaction) error {
+		started <- true
+		<-m.Context().Done()
+		errs <- m.Context().Err()
+		return m.Context().Err()
+	})
+	<-started
+	r.stop()
+
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("context error = %v, want %v", err, context.Canceled)
+	}
+	if stats := waitForStats(t, r); stats.Retried != 1 {
+		t.Errorf("stats = %+v, want message retried", stats)
+	}
+}
+
+func TestReceiverMessageTimeout(t *testing.T) {
+	errs := make(chan error, 1)
+	r := startMemoryReceiver(t, 20*time.Millisecond, func(m *Message, txn Transaction) error {
+		<-m.Context().Done()
+		errs <- m.Context().Err()
+		//handler errors once deadline expires are treated as temporary.
+		return errHandled
+	})
+	defer r.stop()
+
+	if err := <-errs; err != context.DeadlineExceeded {
+		t.Errorf("context error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if stats := waitForStats(t, r); stats.Retried != 1 || stats.Failed != 0 {
+		t.Errorf("stats = %+v, want message retried", stats)
+	}
+}
+
+func TestReceiverHandlerDoneAfterCancellation(t *testing.T) {
+	r := startMemoryReceiver(t, 20*time.Millisecond, func(m *Message, txn Transaction) error {
+		<-m.Context().Done()
+		return nil
+	})
+	defer r.stop()
+
+	if stats := waitForStats(t, r); stats.Processed != 1 || stats.Retried != 0 {
+		t.Errorf("stats = %+v, want message processed", stats)
+	}
+}
+
+func TestAdaptContextHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := &Message{ctx: ctx}
+	f := AdaptContextHandler(func(got context.Context, msg *Message) error {
+		if got != ctx {
+			t.Errorf("handler got a context other than that of message")
+		}
+		if msg != m {
+			t.Errorf("handler got a different message")
+		}
+		return errHandled
+	})
+	if err := f(m, nil); err != errHandled {
+		t.Errorf("error = %v, want %v", err, errHandled)
+	}
+}
+
+func TestReceiverSkipsWaitOfUnstampedMessages(t *testing.T) {
+	r := startMemoryReceiver(t, 0, func(m *Message, txn Transaction) error {
+		return nil
+	})
+	waitForStats(t, r)
+	r.stop()
+
+	//message from an old sender, stamped only when enqueued.
+	m := PrepareMessage("m2", testMsgType, "data", "")
+	m.SentAt = time.Time{}
+	m.EnqueuedAt = time.Now().Add(-time.Minute)
+	m.receivedAt = time.Now()
+	atomic.StoreInt64(&r.state.queueWait, 0)
+	r.recordQueueWait(&m)
+	if wait := r.GetQueueWait(); wait != 0 {
+		t.Errorf("queue wait = %s, want unstamped message skipped", wait)
+	}
+	if str := m.String(); strings.Contains(str, "SentAt") {
+		t.Errorf("message = %s, want unset SentAt omitted", str)
+	}
+}
@@ -0,0 +1,96 @@
+package raven
+
+import (
+	"sync"
+)
+
+//
+// What to do with messages for which no handler is defined.
+//
+const (
+	//Move message to dead box, the default.
+	UNKNOWN_TYPE_DEAD = "dead"
+	//Mark message as processed, without handling.
+	UNKNOWN_TYPE_DISCARD = "discard"
+	//Retry message, as per retry policy of receiver.
+	UNKNOWN_TYPE_RETRY = "retry"
+)
+
+//
+// Mux routes messages to handlers based on their type.
+// Pass mux.HandleMessage as the MessageHandler of receiver.
+//
+//	mux := raven.NewMux()
+//	mux.Handle("order.created", onOrderCreated)
+//	mux.Handle("order.cancelled", onOrderCancelled)
+//	receiver.Start(mux.HandleMessage)
+//
+type Mux struct {
+	mutex    sync.RWMutex
+	handlers map[string]MessageHandler
+	fallback MessageHandler
+	unknown  string
+}
+
+func NewMux() *Mux {
+	return &Mux{
+		handlers: make(map[string]MessageHandler),
+		unknown:  UNKNOWN_TYPE_DEAD,
+	}
+}
+
+//
+// Register handler for messages of the given type.
+//
+func (this *Mux) Handle(msgType string, h MessageHandler) *Mux {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.handlers[msgType] = h
+	return this
+}
+
+//
+// Register handler for messages whose type has no handler.
+//
+func (this *Mux) HandleDefault(h MessageHandler) *Mux {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.fallback = h
+	return this
+}
+
+//
+// Define what to do with messages of unknown type, in absence of a default handler.
+// One of UNKNOWN_TYPE_DEAD, UNKNOWN_TYPE_DISCARD or UNKNOWN_TYPE_RETRY.
+//
+func (this *Mux) SetUnknownPolicy(policy string) *Mux {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.unknown = policy
+	return this
+}
+
+//
+// Route message to its handler, satisfies MessageHandler.
+//
+func (this *Mux) HandleMessage(m *Message, txn Transaction) error {
+	this.mutex.RLock()
+	h, ok := this.handlers[m.Type]
+	if !ok {
+		h = this.fallback
+	}
+	unknown := this.unknown
+	this.mutex.RUnlock()
+
+	if h != nil {
+		return h(m, txn)
+	}
+	switch unknown {
+	case UNKNOWN_TYPE_DISCARD:
+		return nil
+	case UNKNOWN_TYPE_RETRY:
+		return ErrTmpFailure
+	default:
+		return ErrUnknownType
+	}
+}
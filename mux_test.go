@@ -0,0 +1,75 @@
+package raven
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var errHandled = errors.New("handled")
+
+// handler returning err, recording its name in called.
+func namedHandler(name string, called *string, err error) MessageHandler {
+	return func(m *Message, txn Transaction) error {
+		*called = name
+		return err
+	}
+}
+
+func TestMuxRouting(t *testing.T) {
+	cases := []struct {
+		name     string
+		msgType  string
+		fallback bool
+		policy   string
+		called   string
+		err      error
+	}{
+		{"routed to handler of type", "order.created", false, "", "created", nil},
+		{"routed to other handler", "order.cancelled", false, "", "cancelled", errHandled},
+		{"known type ignores fallback", "order.created", true, "", "created", nil},
+		{"unknown type goes to fallback", "order.updated", true, UNKNOWN_TYPE_DISCARD, "fallback", nil},
+		{"unknown type is dead by default", "order.updated", false, "", "", ErrUnknownType},
+		{"unknown type is dead", "order.updated", false, UNKNOWN_TYPE_DEAD, "", ErrUnknownType},
+		{"unknown type is discarded", "order.updated", false, UNKNOWN_TYPE_DISCARD, "", nil},
+		{"unknown type is retried", "order.updated", false, UNKNOWN_TYPE_RETRY, "", ErrTmpFailure},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var called string
+			mux := NewMux().
+				Handle("order.created", namedHandler("created", &called, nil)).
+				Handle("order.cancelled", namedHandler("cancelled", &called, errHandled))
+			if c.fallback {
+				mux.HandleDefault(namedHandler("fallback", &called, nil))
+			}
+			if c.policy != "" {
+				mux.SetUnknownPolicy(c.policy)
+			}
+			err := mux.HandleMessage(&Message{Type: c.msgType}, nil)
+			if err != c.err {
+				t.Errorf("HandleMessage() error = %v, want %v", err, c.err)
+			}
+			if called != c.called {
+				t.Errorf("HandleMessage() called %q, want %q", called, c.called)
+			}
+		})
+	}
+}
+
+func TestTypeStatsRecord(t *testing.T) {
+	stats := newTypeStats()
+	stats.record("order.created", nil)
+	stats.record("order.created", nil)
+	stats.record("order.created", ErrTmpFailure)
+	stats.record("order.created", errHandled)
+	stats.record("order.updated", ErrUnknownType)
+
+	want := map[string]TypeStats{
+		"order.created": {Received: 4, Processed: 2, Retried: 1, Failed: 1},
+		"order.updated": {Received: 1, Failed: 1, Unknown: 1},
+	}
+	if got := stats.snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshot() = %+v, want %+v", got, want)
+	}
+}
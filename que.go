@@ -39,6 +39,28 @@ func (this *MsgBox) GetBoxId() string {
 	return strings.ToLower(this.boxId)
 }
 
+//
+// Box holding messages scheduled for future delivery to this box.
+// It shares bucket with the box, so both live on the same redis cluster slot.
+//
+func (this *MsgBox) getScheduledBox() MsgBox {
+	return createMsgBox(this.name+"-scheduled", this.boxId)
+}
+
+//
+// Sorted set tracking visibility deadline of messages being processed from this box.
+//
+func (this *MsgBox) getInflightBox() MsgBox {
+	return createMsgBox(this.name+"-inflight", this.boxId)
+}
+
+//
+// Hash counting visibility expiries of messages being processed from this box.
+//
+func (this *MsgBox) getExpiriesBox() MsgBox {
+	return createMsgBox(this.name+"-expiries", this.boxId)
+}
+
 //
 // Exposed method for creation of new Source.
 //
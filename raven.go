@@ -4,10 +4,17 @@ import "fmt"
 
 const FARM_TYPE_REDISCLUSTER = "redis-cluster"
 const FARM_TYPE_REDIS = "redis-simple"
+const FARM_TYPE_MEMORY = "memory"
+const FARM_TYPE_REDISSTREAM = "redis-stream"
+const FARM_TYPE_DISK = "disk"
 
 const CHILD_LOCK_TIMEOUT = 60          //inseconds
 const CHILD_LOCK_REFRESH_INTERVAL = 30 //inseconds
 
+const GROUP_LEASE_TIMEOUT = 15         //inseconds
+const GROUP_LEASE_REFRESH_INTERVAL = 3 //inseconds
+const GROUP_REBALANCE_INTERVAL = 5     //inseconds
+
 //
 // Entry point to this library.
 // mtype: Farm magaer type.
@@ -15,6 +22,7 @@ const CHILD_LOCK_REFRESH_INTERVAL = 30 //inseconds
 //
 func InitializeFarm(mtype string, config interface{}, inlogger Logger) (*Farm, error) {
 	f := new(Farm)
+	f.metrics = newMetrics()
 
 	//assign logger
 	f.logger = new(DummyLogger)
@@ -34,8 +42,42 @@ func InitializeFarm(mtype string, config interface{}, inlogger Logger) (*Farm, e
 		redis := InitializeRedis(conf)
 		f.manager = redis
 		return f, nil
+	case FARM_TYPE_REDISSTREAM:
+		conf := config.(RedisStreamConfig)
+		f.manager = InitializeRedisStream(conf)
+		return f, nil
+	case FARM_TYPE_DISK:
+		conf := config.(DiskConfig)
+		disk, err := InitializeDisk(conf)
+		if err != nil {
+			return nil, err
+		}
+		f.manager = disk
+		return f, nil
+	case FARM_TYPE_MEMORY:
+		var conf MemoryConfig
+		if config != nil {
+			conf = config.(MemoryConfig)
+		}
+		f.manager = InitializeMemory(conf)
+		return f, nil
 
 	default:
 		return nil, fmt.Errorf("Not a Valid Raven Manager supplied")
 	}
 }
+
+//
+// Initialize a farm around an already created Raven Manager.
+// Useful for custom manager implementations and tests.
+//
+func InitializeFarmWithManager(manager RavenManager, inlogger Logger) *Farm {
+	f := new(Farm)
+	f.metrics = newMetrics()
+	f.logger = new(DummyLogger)
+	if inlogger != nil {
+		f.logger = inlogger
+	}
+	f.manager = manager
+	return f
+}
@@ -1,8 +1,9 @@
 package raven
 
 import (
+	"fmt"
+
 	"github.com/kukkar/raven/childlock"
-	newrelic "github.com/newrelic/go-agent"
 )
 
 //
@@ -11,14 +12,68 @@ import (
 // each raven.
 //
 type Farm struct {
-	manager     RavenManager
-	logger      Logger
-	newrelicApp newrelic.Application
-	lockManager *childlock.LockManager
+	manager         RavenManager
+	codec           Codec
+	logger          Logger
+	instrumentation Instrumentation
+	metrics         *metrics
+	tracer          Tracer
+	lockManager     *childlock.LockManager
+}
+
+//
+// Define where metrics and traces of farm are reported, nothing is reported by default.
+//
+func (this *Farm) SetInstrumentation(i Instrumentation) {
+	this.instrumentation = i
+}
+
+//
+// Get the instrumentation of farm.
+//
+func (this *Farm) GetInstrumentation() Instrumentation {
+	if this.instrumentation == nil {
+		return NoopInstrumentation{}
+	}
+	return this.instrumentation
 }
 
-func (this *Farm) AttachNewRelicApp(app newrelic.Application) {
-	this.newrelicApp = app
+//
+// Define the codec used to encode messages, JsonCodec is used by default.
+// All the producers and consumers of a queue need to use the same codec.
+//
+func (this *Farm) SetCodec(c Codec) error {
+	aware, ok := this.manager.(CodecAware)
+	if !ok {
+		return fmt.Errorf("Raven Manager does not support pluggable codecs")
+	}
+	aware.SetCodec(c)
+	this.codec = c
+	return nil
+}
+
+//
+// Get the codec used to encode messages.
+//
+func (this *Farm) GetCodec() Codec {
+	if this.codec == nil {
+		return DefaultCodec
+	}
+	return this.codec
+}
+
+//
+// Get the logger attached to farm.
+//
+func (this *Farm) GetLogger() Logger {
+	return this.logger
+}
+
+//
+// Attach a tracer, propagating traces from senders to receivers of messages.
+//
+func (this *Farm) SetTracer(t Tracer) {
+	this.tracer = t
 }
 
 func (this *Farm) AttachLock(options childlock.RedisOptions) {
@@ -53,6 +108,10 @@ func (this *Farm) GetRavenReceiver(id string, s Source) (*RavenReceiver, error)
 	receiver.farm = this
 
 	//Add lock details to receiver.
+	//Not required incase manager itself distributes messages among receivers.
+	if shared, ok := this.manager.(sharedReceiving); ok && shared.allowsSharedReceivers() {
+		return receiver, nil
+	}
 	if this.lockManager != nil {
 		receiver.lock = this.lockManager.NewLock(receiver.GetId(), CHILD_LOCK_TIMEOUT)
 	}
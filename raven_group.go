@@ -0,0 +1,318 @@
+package raven
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sanksons/gowraps/util"
+
+	"github.com/kukkar/raven/childlock"
+)
+
+//
+// receiverGroup lets multiple processes run the same receiver in group mode.
+// Processes join a group and message boxes of source are distributed among live
+// members, each box being consumed by the member holding its lease.
+// Boxes are rebalanced as members join or leave, a box is stopped as soon as
+// its lease can not be refreshed. A box taken over is started only after its
+// lease has been held for a lease timeout, so that the previous owner has
+// stopped processing it before its messages are requeued.
+// Boxes are stopped in background outside of mutex, as stopping waits for messages
+// being handled, so that a slow box does not hold back refreshing leases of others.
+//
+type receiverGroup struct {
+	receiver *RavenReceiver
+	group    *childlock.Group
+
+	//leases held, against msgreceiver id.
+	leases map[string]*childlock.Lock
+
+	//time of acquiring leases of boxes yet to be started, against msgreceiver id.
+	pending map[string]time.Time
+
+	//boxes being stopped, against msgreceiver id. They are not acquired again till stopped.
+	stopping map[string]bool
+	stoppers sync.WaitGroup
+
+	//timeout of leases in seconds, and intervals at which they are
+	//refreshed and boxes are rebalanced.
+	leaseTimeout      int
+	refreshInterval   time.Duration
+	rebalanceInterval time.Duration
+
+	handler MessageHandler
+	mutex   sync.Mutex
+
+	//closed on stop, to shutdown lease refresher and rebalancer.
+	quit     chan struct{}
+	stopped  chan bool
+	stopOnce sync.Once
+}
+
+func newReceiverGroup(receiver *RavenReceiver, f MessageHandler) *receiverGroup {
+	host, _ := os.Hostname()
+	member := fmt.Sprintf("%s-%d-%s", host, os.Getpid(), uuid.New().String()[:8])
+	return &receiverGroup{
+		receiver: receiver,
+		group: receiver.farm.lockManager.NewGroup(
+			receiver.GetId()+"-members", member, GROUP_LEASE_TIMEOUT,
+		),
+		leases:            make(map[string]*childlock.Lock),
+		pending:           make(map[string]time.Time),
+		stopping:          make(map[string]bool),
+		leaseTimeout:      GROUP_LEASE_TIMEOUT,
+		refreshInterval:   GROUP_LEASE_REFRESH_INTERVAL * time.Second,
+		rebalanceInterval: GROUP_REBALANCE_INTERVAL * time.Second,
+		handler:           f,
+		quit:              make(chan struct{}),
+		stopped:           make(chan bool),
+	}
+}
+
+//
+// Join group, pick boxes and keep refreshing their leases and rebalancing them
+// till stopped.
+//
+func (this *receiverGroup) start() error {
+	if err := this.group.Join(); err != nil {
+		return err
+	}
+	this.rebalance()
+	go this.every("Refresh leases", this.refreshInterval, this.refreshLeases)
+	go this.every("Rebalance", this.rebalanceInterval, this.rebalance)
+	return nil
+}
+
+// run f at every interval, till group is stopped.
+func (this *receiverGroup) every(name string, interval time.Duration, f func()) {
+	for {
+		select {
+		case <-this.quit:
+			this.stopped <- true
+			return
+		case <-time.After(interval):
+		}
+		func() {
+			defer util.PanicHandler(fmt.Sprintf("%s: %s", name, this.receiver.GetId()))
+			f()
+		}()
+	}
+}
+
+//
+// Stop all boxes, release leases and leave group. Stopping again is a no-op.
+//
+func (this *receiverGroup) stop() {
+	this.stopOnce.Do(this.leave)
+}
+
+func (this *receiverGroup) leave() {
+	close(this.quit)
+	//wait for refresher and rebalancer, and boxes they are stopping.
+	<-this.stopped
+	<-this.stopped
+	this.stoppers.Wait()
+
+	this.mutex.Lock()
+	boxes := make([]*MsgReceiver, 0)
+	leases := make(map[string]*childlock.Lock)
+	for _, m := range this.receiver.msgReceivers {
+		if _, ok := this.leases[m.id]; ok {
+			boxes = append(boxes, m)
+			leases[m.id] = this.takeBox(m)
+		}
+	}
+	this.mutex.Unlock()
+	this.stopBoxes(boxes, leases)
+
+	if err := this.group.Leave(); err != nil {
+		this.log("error", fmt.Sprintf("Could not leave group. Error: %s", err.Error()))
+		return
+	}
+	this.log("info", "Left group")
+}
+
+//
+// Bring boxes consumed by this member in line with its share.
+//
+func (this *receiverGroup) rebalance() {
+	this.stopInBackground(this.reassign())
+}
+
+//
+// Acquire boxes falling in share of this member, and take off the ones that do not,
+// returning them alongwith their leases to be released once stopped.
+//
+func (this *receiverGroup) reassign() ([]*MsgReceiver, map[string]*childlock.Lock) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	boxes := make([]*MsgReceiver, 0)
+	leases := make(map[string]*childlock.Lock)
+	if err := this.group.Join(); err != nil {
+		this.log("error", fmt.Sprintf("Could not renew group membership. Error: %s", err.Error()))
+		return boxes, leases
+	}
+	members, err := this.group.Members()
+	if err != nil {
+		this.log("error", fmt.Sprintf("Could not fetch group members. Error: %s", err.Error()))
+		return boxes, leases
+	}
+	share := assignBoxes(len(this.receiver.msgReceivers), members, this.group.GetMember())
+	for i, m := range this.receiver.msgReceivers {
+		_, held := this.leases[m.id]
+		if held && !share[i] {
+			this.log("info", fmt.Sprintf("Handing over box [%s] to another member", m.id))
+			boxes = append(boxes, m)
+			leases[m.id] = this.takeBox(m)
+		} else if !held && share[i] {
+			this.acquireBox(m)
+		}
+	}
+	return boxes, leases
+}
+
+//
+// Refresh leases of boxes, boxes whose lease is lost have their messages cancelled
+// right away and are stopped. Boxes whose lease has been held long enough are started.
+//
+func (this *receiverGroup) refreshLeases() {
+	this.mutex.Lock()
+	lost := make([]*MsgReceiver, 0)
+	for _, m := range this.receiver.msgReceivers {
+		lease, ok := this.leases[m.id]
+		if !ok {
+			continue
+		}
+		if err := lease.Refresh(); err != nil {
+			this.log("error", fmt.Sprintf("Lost lease of box [%s], stopping it. Error: %s", m.id, err.Error()))
+			if m.isRunning() {
+				m.cancel()
+			}
+			lost = append(lost, m)
+			this.takeBox(m)
+		}
+	}
+	this.startDue()
+	this.mutex.Unlock()
+	this.stopInBackground(lost, nil)
+}
+
+//
+// Start boxes whose lease has been held for a lease timeout, by then a previous
+// owner that lost it has noticed and stopped.
+//
+func (this *receiverGroup) startDue() {
+	wait := time.Duration(this.leaseTimeout) * time.Second
+	for _, m := range this.receiver.msgReceivers {
+		acquiredAt, ok := this.pending[m.id]
+		if !ok || time.Since(acquiredAt) < wait {
+			continue
+		}
+		delete(this.pending, m.id)
+		if err := m.preStart(); err != nil {
+			this.log("error", fmt.Sprintf("Could not start box [%s]. Error: %s", m.id, err.Error()))
+			this.leases[m.id].Release()
+			delete(this.leases, m.id)
+			continue
+		}
+		this.log("info", fmt.Sprintf("Starting box [%s]", m.id))
+		m.run(this.handler)
+	}
+}
+
+func (this *receiverGroup) acquireBox(m *MsgReceiver) {
+	if this.stopping[m.id] {
+		//yet to be stopped, retry on next rebalance.
+		return
+	}
+	lease := this.receiver.farm.lockManager.NewLock(
+		this.receiver.GetId()+"-"+m.id, this.leaseTimeout,
+	)
+	if err := lease.Acquire(this.group.GetMember()); err != nil {
+		//previous owner is yet to hand it over, retry on next rebalance.
+		if err != childlock.ERR_LOCK_BUSY {
+			this.log("error", fmt.Sprintf("Could not acquire lease of box [%s]. Error: %s", m.id, err.Error()))
+		}
+		return
+	}
+	this.leases[m.id] = lease
+	this.pending[m.id] = time.Now()
+	this.log("info", fmt.Sprintf("Acquired lease of box [%s], starting it in %ds", m.id, this.leaseTimeout))
+}
+
+//
+// Take box off leases held, marking it as being stopped. Returns its lease.
+// Must be called with mutex held.
+//
+func (this *receiverGroup) takeBox(m *MsgReceiver) *childlock.Lock {
+	lease := this.leases[m.id]
+	delete(this.leases, m.id)
+	delete(this.pending, m.id)
+	this.stopping[m.id] = true
+	return lease
+}
+
+// stop boxes taken off in background, see stopBoxes.
+func (this *receiverGroup) stopInBackground(boxes []*MsgReceiver, leases map[string]*childlock.Lock) {
+	if len(boxes) == 0 {
+		return
+	}
+	this.stoppers.Add(1)
+	go func() {
+		defer this.stoppers.Done()
+		defer util.PanicHandler(fmt.Sprintf("Stop boxes: %s", this.receiver.GetId()))
+		this.stopBoxes(boxes, leases)
+	}()
+}
+
+//
+// Stop boxes taken off, without holding mutex, releasing their leases if given.
+//
+func (this *receiverGroup) stopBoxes(boxes []*MsgReceiver, leases map[string]*childlock.Lock) {
+	for _, m := range boxes {
+		m.stop()
+		if lease, ok := leases[m.id]; ok {
+			if err := lease.Release(); err != nil {
+				this.log("error", fmt.Sprintf("Could not release lease of box [%s]. Error: %s", m.id, err.Error()))
+			}
+		}
+		this.mutex.Lock()
+		delete(this.stopping, m.id)
+		this.mutex.Unlock()
+	}
+}
+
+func (this *receiverGroup) log(ltype string, msg string) {
+	logger := this.receiver.farm.logger
+	switch ltype {
+	case "error":
+		logger.Error(this.receiver.GetId(), this.group.GetMember(), msg)
+	default:
+		logger.Info(this.receiver.GetId(), this.group.GetMember(), msg)
+	}
+}
+
+//
+// Share of boxes for member, boxes are dealt to sorted members in turns.
+//
+func assignBoxes(boxes int, members []string, member string) []bool {
+	share := make([]bool, boxes)
+	pos := -1
+	for i, m := range members {
+		if m == member {
+			pos = i
+			break
+		}
+	}
+	if pos < 0 {
+		return share
+	}
+	for i := range share {
+		share[i] = i%len(members) == pos
+	}
+	return share
+}
@@ -0,0 +1,272 @@
+package raven
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/kukkar/raven/childlock"
+)
+
+func TestAssignBoxes(t *testing.T) {
+	cases := []struct {
+		name    string
+		boxes   int
+		members []string
+		member  string
+		want    []bool
+	}{
+		{"member missing", 3, []string{"a", "b"}, "c", []bool{false, false, false}},
+		{"no members", 2, nil, "a", []bool{false, false}},
+		{"single member", 3, []string{"a"}, "a", []bool{true, true, true}},
+		{"first of two", 4, []string{"a", "b"}, "a", []bool{true, false, true, false}},
+		{"second of two", 4, []string{"a", "b"}, "b", []bool{false, true, false, true}},
+		{"last of three", 5, []string{"a", "b", "c"}, "c", []bool{false, false, true, false, false}},
+		{"more members than boxes", 2, []string{"a", "b", "c"}, "b", []bool{false, true}},
+		{"left without box", 2, []string{"a", "b", "c"}, "c", []bool{false, false}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := assignBoxes(c.boxes, c.members, c.member); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("assignBoxes() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestAssignBoxesCoversAllBoxes(t *testing.T) {
+	members := []string{"a", "b", "c"}
+	for boxes := 1; boxes <= 7; boxes++ {
+		owners := make([]int, boxes)
+		for _, member := range members {
+			for i, mine := range assignBoxes(boxes, members, member) {
+				if mine {
+					owners[i]++
+				}
+			}
+		}
+		for i, n := range owners {
+			if n != 1 {
+				t.Errorf("box %d of %d assigned to %d members, want 1", i, boxes, n)
+			}
+		}
+	}
+}
+
+//
+// Records messages handled by members of a group.
+//
+type groupHandled struct {
+	mutex sync.Mutex
+	count map[string]int
+}
+
+func (this *groupHandled) handler(m *Message, txn Transaction) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.count[m.Id]++
+	return nil
+}
+
+func (this *groupHandled) get() map[string]int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	count := make(map[string]int, len(this.count))
+	for id, n := range this.count {
+		count[id] = n
+	}
+	return count
+}
+
+// start a member of group on redis at addr handling messages with f, with short leases and intervals.
+func startGroupMember(t *testing.T, addr string, f MessageHandler) *receiverGroup {
+	farm, err := InitializeFarm(FARM_TYPE_REDIS, RedisSimpleConfig{Addr: addr, BlockFor: time.Second}, nil)
+	if err != nil {
+		t.Fatalf("Could not initialize farm: %s", err)
+	}
+	farm.AttachLock(childlock.RedisOptions{Addres: []string{addr}})
+	receiver, err := farm.GetRavenReceiver("grouped", CreateSource("orders", 4))
+	if err != nil {
+		t.Fatalf("Could not create receiver: %s", err)
+	}
+	g := newReceiverGroup(receiver, f)
+	g.leaseTimeout = 1
+	g.refreshInterval = 50 * time.Millisecond
+	g.rebalanceInterval = 50 * time.Millisecond
+	if err := g.start(); err != nil {
+		t.Fatalf("Could not start group: %s", err)
+	}
+	receiver.group = g
+	return g
+}
+
+// ids of boxes being consumed by member.
+func (this *receiverGroup) consuming() []string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	ids := make([]string, 0)
+	for _, m := range this.receiver.msgReceivers {
+		if m.isRunning() {
+			ids = append(ids, m.id)
+		}
+	}
+	return ids
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestGroupHandover(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Could not start redis: %s", err)
+	}
+	defer s.Close()
+
+	handled := &groupHandled{count: make(map[string]int)}
+	first := startGroupMember(t, s.Addr(), handled.handler)
+	defer first.stop()
+	waitFor(t, "first member to consume all boxes", func() bool {
+		return len(first.consuming()) == 4
+	})
+
+	//boxes are shared once second member joins.
+	second := startGroupMember(t, s.Addr(), handled.handler)
+	waitFor(t, "boxes to be shared", func() bool {
+		return len(first.consuming()) == 2 && len(second.consuming()) == 2
+	})
+	owned := make(map[string]bool)
+	for _, id := range append(first.consuming(), second.consuming()...) {
+		if owned[id] {
+			t.Fatalf("Box [%s] consumed by both members", id)
+		}
+		owned[id] = true
+	}
+
+	farm := first.receiver.farm
+	dest := CreateDestination("orders", 4, nil)
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("msg-%d", i)
+		if err := farm.GetRaven().HandMessage(PrepareMessage(id, "", "data", id)).SetDestination(dest).Fly(); err != nil {
+			t.Fatalf("Could not send message: %s", err)
+		}
+	}
+	waitFor(t, "messages to be handled", func() bool {
+		return len(handled.get()) == 20
+	})
+	for id, n := range handled.get() {
+		if n != 1 {
+			t.Errorf("Message [%s] handled %d times, want 1", id, n)
+		}
+	}
+
+	//boxes are handed back once second member leaves, leaving again is a no-op.
+	second.stop()
+	second.stop()
+	if n := len(second.consuming()); n != 0 {
+		t.Errorf("Member consuming %d boxes after leaving, want 0", n)
+	}
+	waitFor(t, "first member to take back all boxes", func() bool {
+		return len(first.consuming()) == 4
+	})
+}
+
+func TestGroupStopsBoxOnLostLease(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Could not start redis: %s", err)
+	}
+	defer s.Close()
+
+	g := startGroupMember(t, s.Addr(), (&groupHandled{count: make(map[string]int)}).handler)
+	defer g.stop()
+	waitFor(t, "member to consume all boxes", func() bool {
+		return len(g.consuming()) == 4
+	})
+
+	//lease is taken over by someone else.
+	box := g.receiver.msgReceivers[0]
+	s.Set(g.receiver.GetId()+"-"+box.id, "intruder")
+	waitFor(t, "box to be stopped", func() bool {
+		return len(g.consuming()) == 3
+	})
+	for _, id := range g.consuming() {
+		if id == box.id {
+			t.Fatalf("Box [%s] consumed after losing its lease", id)
+		}
+	}
+}
+
+func TestGroupKeepsLeasesWhileStoppingBox(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Could not start redis: %s", err)
+	}
+	defer s.Close()
+
+	//handlers ignore cancellation, blocking till released.
+	started := make(chan bool, 100)
+	release := make(chan struct{})
+	g := startGroupMember(t, s.Addr(), func(m *Message, txn Transaction) error {
+		started <- true
+		<-release
+		return nil
+	})
+	defer g.stop()
+	released := false
+	defer func() {
+		if !released {
+			close(release)
+		}
+	}()
+	waitFor(t, "member to consume all boxes", func() bool {
+		return len(g.consuming()) == 4
+	})
+
+	farm := g.receiver.farm
+	dest := CreateDestination("orders", 4, nil)
+	for i := 0; i < 40; i++ {
+		id := fmt.Sprintf("msg-%d", i)
+		if err := farm.GetRaven().HandMessage(PrepareMessage(id, "", "data", id)).SetDestination(dest).Fly(); err != nil {
+			t.Fatalf("Could not send message: %s", err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		<-started
+	}
+
+	//box stopping on losing its lease, is blocked on its handler well past lease timeout.
+	box := g.receiver.msgReceivers[0]
+	s.Set(g.receiver.GetId()+"-"+box.id, "intruder")
+	for elapsed := time.Duration(0); elapsed < 3*time.Second; elapsed += 100 * time.Millisecond {
+		time.Sleep(100 * time.Millisecond)
+		s.FastForward(100 * time.Millisecond)
+		for _, m := range g.receiver.msgReceivers[1:] {
+			if owner, err := s.Get(g.receiver.GetId() + "-" + m.id); err != nil || owner != g.group.GetMember() {
+				t.Fatalf("Lease of box [%s] lost while another box is stopping, owner: %q, err: %v", m.id, owner, err)
+			}
+		}
+	}
+
+	close(release)
+	released = true
+	waitFor(t, "box to be stopped", func() bool {
+		return len(g.consuming()) == 3
+	})
+	for _, id := range g.consuming() {
+		if id == box.id {
+			t.Fatalf("Box [%s] consumed after losing its lease", id)
+		}
+	}
+}
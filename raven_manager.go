@@ -1,7 +1,15 @@
 package raven
 
+import "time"
+
 var _ RavenManager = (*RedisSimple)(nil)
 var _ RavenManager = (*RedisCluster)(nil)
+var _ RavenManager = (*Memory)(nil)
+var _ RavenManager = (*RedisStream)(nil)
+var _ RavenManager = (*Disk)(nil)
+var _ BatchSender = (*RedisSimple)(nil)
+var _ BatchSender = (*RedisCluster)(nil)
+var _ BatchSender = (*RedisStream)(nil)
 
 //
 // An interface to be implemented by all Raven Managers.
@@ -16,6 +24,13 @@ type RavenManager interface {
 	// Message to be sent, Destination name
 	Send(message Message, destination Destination) error
 
+	// Message to be delivered to destination at the specified time.
+	SendAt(message Message, destination Destination, at time.Time) error
+
+	// Move messages due for delivery from schedule to the box of receiver.
+	// Returns number of messages moved.
+	PromoteScheduled(r MsgReceiver) (int, error)
+
 	// Source from which message is to be received.
 	// Q in which message is to be stored for temporary basis.
 	Receive(r MsgReceiver) (*Message, error)
@@ -32,15 +47,39 @@ type RavenManager interface {
 	//Reque message.
 	RequeMessage(message Message, r MsgReceiver) error
 
+	//Reque message to be delivered again at the specified time.
+	DelayMessage(message Message, r MsgReceiver, at time.Time) error
+
+	// Return messages being processed for longer than visibility timeout of
+	// receiver, back to its box. Returns number of messages returned.
+	ReapExpired(r MsgReceiver) (int, error)
+
 	//Show messages reciding in dead Q
 	ShowDeadQ(r MsgReceiver) ([]*Message, error)
 
+	// List a page of dead messages matching filter, oldest first, upto limit.
+	// Page is continued from cursor, if not empty, and carries cursor of next page.
+	BrowseDeadQ(r MsgReceiver, filter DeadFilter, cursor string, limit int) (DeadPage, error)
+
 	//Get messages residing in DeadQ.
 	GetDeadQCount(r MsgReceiver) (int, error)
 
 	//Flush DeadQ
 	FlushDeadQ(r MsgReceiver) error
 
+	// Move dead messages matching filter back to box of receiver, oldest first and
+	// upto limit if positive. Messages are moved atomically, each either stays dead
+	// or is replayed. Returns number of messages replayed.
+	ReplayDead(r MsgReceiver, filter DeadFilter, limit int) (int, error)
+
+	// Delete dead messages matching filter, oldest first and upto limit if positive.
+	// Returns number of messages deleted.
+	DeleteDead(r MsgReceiver, filter DeadFilter, limit int) (int, error)
+
+	// Remove dead messages exceeding retention, oldest first. Messages are archived
+	// to archive of retention before being removed. Returns number of messages removed.
+	ExpireDead(r MsgReceiver, retention DeadRetention) (int, error)
+
 	//Flush All associated queues with a Receiver.
 	FlushAll(r MsgReceiver) error
 
@@ -50,3 +89,11 @@ type RavenManager interface {
 	//Quit receiving messages
 	Quit(r MsgReceiver) error
 }
+
+//
+// Implemented by managers that distribute messages of a box among multiple
+// receivers on their own. Receivers of such managers do not need to be singleton.
+//
+type sharedReceiving interface {
+	allowsSharedReceivers() bool
+}
@@ -0,0 +1,184 @@
+package raven_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/kukkar/raven"
+	"github.com/kukkar/raven/ravenmanagertest"
+)
+
+//Minimum blocking duration supported by redis.
+const testBlockFor = time.Second
+
+func startMiniRedis(t *testing.T) *miniredis.Miniredis {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Could not start redis: %s", err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestRedisSimpleManager(t *testing.T) {
+	ravenmanagertest.Run(t, func(t *testing.T) raven.RavenManager {
+		s := startMiniRedis(t)
+		return raven.InitializeRedis(raven.RedisSimpleConfig{
+			Addr:     s.Addr(),
+			BlockFor: testBlockFor,
+		})
+	})
+}
+
+func TestRedisClusterManager(t *testing.T) {
+	ravenmanagertest.Run(t, func(t *testing.T) raven.RavenManager {
+		s := startMiniRedis(t)
+		return raven.InitializeRedisCluster(raven.RedisClusterConfig{
+			Addrs:    []string{s.Addr()},
+			BlockFor: testBlockFor,
+		})
+	})
+}
+
+func TestRedisStreamManager(t *testing.T) {
+	ravenmanagertest.Run(t, func(t *testing.T) raven.RavenManager {
+		s := startMiniRedis(t)
+		return raven.InitializeRedisStream(raven.RedisStreamConfig{
+			Addrs:    []string{s.Addr()},
+			Consumer: "conformance",
+			BlockFor: testBlockFor,
+			//crashed receivers come back right away in conformance tests.
+			ClaimIdle: time.Nanosecond,
+		})
+	})
+}
+
+// newStreamReceiver returns first message receiver of a reliable receiver on a new redis stream manager.
+func newStreamReceiver(t *testing.T, addr string, claimIdle time.Duration) (raven.RavenManager, raven.MsgReceiver) {
+	manager := raven.InitializeRedisStream(raven.RedisStreamConfig{
+		Addrs:     []string{addr},
+		BlockFor:  testBlockFor,
+		ClaimIdle: claimIdle,
+	})
+	receiver, err := raven.InitializeFarmWithManager(manager, nil).GetRavenReceiver("peers", raven.CreateSource("peers", 1))
+	if err != nil {
+		t.Fatalf("Could not create receiver: %s", err)
+	}
+	receiver.MarkReliable()
+	r := *receiver.GetMsgReceivers()[0]
+	if err := manager.PreStartup(r); err != nil {
+		t.Fatalf("PreStartup failed: %s", err)
+	}
+	return manager, r
+}
+
+func TestRedisStreamDoesNotClaimFromLivePeer(t *testing.T) {
+	s := startMiniRedis(t)
+	peer, r := newStreamReceiver(t, s.Addr(), time.Minute)
+	if err := peer.Send(raven.PrepareMessage("m1", "", "data", ""), raven.CreateDestination("peers", 1, nil)); err != nil {
+		t.Fatalf("Send failed: %s", err)
+	}
+	if m, err := peer.Receive(r); err != nil || m == nil {
+		t.Fatalf("Expected peer to receive message, got %v, err: %v", m, err)
+	}
+
+	//another process on the same host starts, while peer is still handling message.
+	manager, r := newStreamReceiver(t, s.Addr(), time.Minute)
+	if m, err := manager.Receive(r); err != raven.ErrEmptyQueue {
+		t.Fatalf("Expected message of live peer not to be claimed, got %v, err: %v", m, err)
+	}
+}
+
+func TestRedisStreamClaimsAllPending(t *testing.T) {
+	s := startMiniRedis(t)
+	crashed, r := newStreamReceiver(t, s.Addr(), time.Millisecond)
+	count := raven.STREAM_PENDING_BATCH + 5
+	for i := 0; i < count; i++ {
+		if err := crashed.Send(raven.PrepareMessage("", "", "data", ""), raven.CreateDestination("peers", 1, nil)); err != nil {
+			t.Fatalf("Send failed: %s", err)
+		}
+		if _, err := crashed.Receive(r); err != nil {
+			t.Fatalf("Receive failed: %s", err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	//entries left pending beyond first page are claimed as well.
+	manager, r := newStreamReceiver(t, s.Addr(), time.Millisecond)
+	for i := 0; i < count; i++ {
+		if _, err := manager.Receive(r); err != nil {
+			t.Fatalf("Expected %d pending messages to be claimed, got %d, err: %v", count, i, err)
+		}
+	}
+	if m, err := manager.Receive(r); err != raven.ErrEmptyQueue {
+		t.Fatalf("Expected no more messages, got %v, err: %v", m, err)
+	}
+}
+
+func TestRedisBatchFailsWithPipeline(t *testing.T) {
+	s := startMiniRedis(t)
+	farm := raven.InitializeFarmWithManager(raven.InitializeRedis(raven.RedisSimpleConfig{
+		Addr:     s.Addr(),
+		BlockFor: testBlockFor,
+	}), nil)
+	//messages are put in box named by their shard key.
+	dest := raven.CreateDestination("batch", 2, func(m raven.Message, boxes int) (string, error) {
+		return m.ShardKey, nil
+	})
+	//second box can not be pushed to, failing the pipeline.
+	s.Set("batch-{2}", "blocked")
+
+	msgs := []raven.Message{
+		raven.PrepareMessage("m1", "", "data", "1"),
+		raven.PrepareMessage("m2", "", "data", "2"),
+	}
+	for i, err := range farm.FlyBatch(dest, msgs) {
+		if err == nil {
+			t.Errorf("Expected message %d of failed pipeline to fail", i)
+		}
+	}
+}
+
+func TestMemoryManager(t *testing.T) {
+	ravenmanagertest.Run(t, func(t *testing.T) raven.RavenManager {
+		return raven.InitializeMemory(raven.MemoryConfig{
+			BlockFor: 10 * time.Millisecond,
+		})
+	})
+}
+
+func TestDiskManager(t *testing.T) {
+	ravenmanagertest.Run(t, func(t *testing.T) raven.RavenManager {
+		disk, err := raven.InitializeDisk(raven.DiskConfig{
+			Dir:      t.TempDir(),
+			Sync:     raven.DISK_SYNC_ALWAYS,
+			BlockFor: 10 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("Could not initialize disk manager: %s", err)
+		}
+		return disk
+	})
+}
+
+func TestDiskDirInUse(t *testing.T) {
+	config := raven.DiskConfig{Dir: t.TempDir(), Sync: raven.DISK_SYNC_NEVER}
+	disk, err := raven.InitializeDisk(config)
+	if err != nil {
+		t.Fatalf("Could not initialize disk manager: %s", err)
+	}
+	if _, err := raven.InitializeDisk(config); err != raven.ErrDiskInUse {
+		t.Fatalf("Expected ErrDiskInUse, got %v", err)
+	}
+	if err := disk.Quit(raven.MsgReceiver{}); err != nil {
+		t.Fatalf("Quit failed: %s", err)
+	}
+	//released once manager quits.
+	disk, err = raven.InitializeDisk(config)
+	if err != nil {
+		t.Fatalf("Could not initialize disk manager after quit: %s", err)
+	}
+	disk.Quit(raven.MsgReceiver{})
+}
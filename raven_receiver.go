@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"text/tabwriter"
 	"time"
 
@@ -17,6 +19,9 @@ import (
 //
 func newRavenReceiver(id string, source Source) (*RavenReceiver, error) {
 	rr := new(RavenReceiver)
+	rr.retryPolicy = DefaultRetryPolicy()
+	rr.concurrency = 1
+	rr.stats = newTypeStats()
 	//Define source and Id for receiver.
 	rr.setSource(source).setId("")
 
@@ -27,6 +32,7 @@ func newRavenReceiver(id string, source Source) (*RavenReceiver, error) {
 			msgbox:  box,
 			parent:  rr,
 			stopped: make(chan bool),
+			state:   new(receiverState),
 		}
 		// Set Id for msgReceiver.
 		m.setId(box.GetName())
@@ -54,6 +60,9 @@ type RavenReceiver struct {
 		//Specifies if we want to use reliable Q or not
 		//@todo: ordering is yet to be implemented.
 		isReliable, ordering bool
+
+		//Specifies if boxes are to be shared among processes running this receiver.
+		grouped bool
 	}
 
 	//All the child receivers.
@@ -64,6 +73,30 @@ type RavenReceiver struct {
 
 	//A lock which ensures singleton receiver.
 	lock *childlock.Lock
+
+	//Specifies if lock is currently held by this receiver, accessed atomically.
+	lockHeld int32
+
+	//Group of processes sharing boxes, in group mode.
+	group *receiverGroup
+
+	//Defines how temporarily failed messages are retried.
+	retryPolicy RetryPolicy
+
+	//Limits messages kept in dead boxes.
+	deadRetention DeadRetention
+
+	//No. of workers processing messages of each message box.
+	concurrency int
+
+	//Counts of messages handled, by type.
+	stats *typeStats
+
+	//Middlewares wrapping message handler, outermost first.
+	middlewares []Middleware
+
+	//Time allowed for processing a message, 0 means no limit.
+	messageTimeout time.Duration
 }
 
 //
@@ -82,6 +115,23 @@ func (this *RavenReceiver) setId(id string) *RavenReceiver {
 	return this
 }
 
+//
+// Get the message receivers, one for each message box of source.
+//
+func (this *RavenReceiver) GetMsgReceivers() []*MsgReceiver {
+	return this.msgReceivers
+}
+
+// message receiver with the given id, nil if there is none.
+func (this *RavenReceiver) getMsgReceiver(id string) *MsgReceiver {
+	for _, r := range this.msgReceivers {
+		if r.id == id {
+			return r
+		}
+	}
+	return nil
+}
+
 //
 // Get allocated port for the receiver.
 //
@@ -105,6 +155,104 @@ func (this *RavenReceiver) setSource(s Source) *RavenReceiver {
 	return this
 }
 
+//
+// Define how messages failing with ErrTmpFailure are retried.
+// Messages running out of attempts are moved to dead box.
+//
+func (this *RavenReceiver) SetRetryPolicy(p RetryPolicy) *RavenReceiver {
+	this.retryPolicy = p
+	return this
+}
+
+//
+// Limit messages kept in dead boxes, messages exceeding retention are removed
+// or archived by a background janitor. Applies to reliable receivers only.
+//
+func (this *RavenReceiver) SetDeadRetention(r DeadRetention) *RavenReceiver {
+	this.deadRetention = r
+	return this
+}
+
+//
+// Messages being processed for longer than timeout are returned to their box by a
+// background reaper, to be received again. Once a message expires maxExpiries times
+// it is moved to dead box instead, 0 means never.
+// Applies to reliable receivers only.
+//
+func (this *RavenReceiver) SetVisibilityTimeout(timeout time.Duration, maxExpiries int) *RavenReceiver {
+	for _, msgReceiver := range this.msgReceivers {
+		msgReceiver.options.visibilityTimeout = timeout
+		msgReceiver.options.maxExpiries = maxExpiries
+	}
+	return this
+}
+
+//
+// Run n workers for each message box, processing messages concurrently.
+// Ordering of messages within a box is not guaranteed with more than one worker.
+//
+func (this *RavenReceiver) SetConcurrency(n int) *RavenReceiver {
+	if n < 1 {
+		n = 1
+	}
+	this.concurrency = n
+	return this
+}
+
+func (this *RavenReceiver) getConcurrency() int {
+	if this.concurrency < 1 {
+		return 1
+	}
+	return this.concurrency
+}
+
+//
+// Limit time allowed for processing a message, context of message is cancelled
+// once it expires and message is retried if handler fails.
+//
+func (this *RavenReceiver) SetMessageTimeout(timeout time.Duration) *RavenReceiver {
+	this.messageTimeout = timeout
+	return this
+}
+
+//
+// Wrap message handler with middlewares, to be called before Start.
+// Middlewares run in the order they are added, the first one being outermost.
+//
+func (this *RavenReceiver) Use(middlewares ...Middleware) *RavenReceiver {
+	this.middlewares = append(this.middlewares, middlewares...)
+	return this
+}
+
+//
+// Get the retry policy of receiver.
+//
+func (this *RavenReceiver) GetRetryPolicy() RetryPolicy {
+	return this.retryPolicy
+}
+
+//
+// Run receiver in group mode, multiple processes running this receiver share
+// the message boxes of source among themselves, instead of a single process
+// consuming all of them. Requires a lock to be attached to farm.
+//
+func (this *RavenReceiver) EnableGroupMode() *RavenReceiver {
+	this.options.grouped = true
+	return this
+}
+
+// Check if boxes are distributed among processes using leases.
+// Not required incase manager itself distributes messages among receivers.
+func (this *RavenReceiver) isGrouped() bool {
+	if !this.options.grouped {
+		return false
+	}
+	if shared, ok := this.farm.manager.(sharedReceiving); ok && shared.allowsSharedReceivers() {
+		return false
+	}
+	return true
+}
+
 //
 // Markall the allotted message receivers as reliable.
 //
@@ -122,6 +270,10 @@ func (this *RavenReceiver) MarkReliable() *RavenReceiver {
 //
 func (this *RavenReceiver) Stop() {
 
+	if this.group != nil {
+		this.group.stop()
+		return
+	}
 	defer func() {
 		this.unlock()
 		fmt.Printf("\nLock released\n")
@@ -162,38 +314,61 @@ func (this *RavenReceiver) Start(f MessageHandler) error {
 		return err
 	}
 
-	//Take lock, this ensures only one receiver is receiving from Q.
-	if err := this.lockme(); err != nil {
-		return err
-	}
-	defer this.unlock()
+	if this.isGrouped() {
+		// In group mode, boxes are started as and when their leases are acquired.
+		group := newReceiverGroup(this, f)
+		if err := group.start(); err != nil {
+			return err
+		}
+		this.group = group
+	} else {
+		//Take lock, this ensures only one receiver is receiving from Q.
+		if err := this.lockme(); err != nil {
+			return err
+		}
+		defer this.unlock()
 
-	//Start a refresher so that lock is refreshed at appropriate intervals
-	this.startLockRefresher()
+		//Start a refresher so that lock is refreshed at appropriate intervals
+		this.startLockRefresher()
 
-	// execute prestart hook of all receivers.
-	// once all prestart hooks are successfull start receivers.
-	for _, msgreceiver := range this.msgReceivers {
-		if err := msgreceiver.preStart(); err != nil {
-			return err
+		// execute prestart hook of all receivers.
+		// once all prestart hooks are successfull start receivers.
+		for _, msgreceiver := range this.msgReceivers {
+			if err := msgreceiver.preStart(); err != nil {
+				return err
+			}
 		}
-	}
 
-	// Start receivers.
-	//   Since the start functions of receivers block, we need to start
-	//   receivers as seperate goroutines.
+		// Start receivers.
+		//   Since the start functions of receivers block, we need to start
+		//   receivers as seperate goroutines.
+		for _, msgreceiver := range this.msgReceivers {
+			msgreceiver.run(f)
+		}
+	}
 	for _, msgreceiver := range this.msgReceivers {
 		go msgreceiver.startHeartBeat()
-		go msgreceiver.start(f)
 	}
 
 	//Once all the receivers are up boot up the server.
 	if err := server.Start(); err != nil {
+		if this.group != nil {
+			//stop boxes and leave group, since member is not going to serve.
+			this.group.stop()
+		}
 		return err
 	}
 	return nil
 }
 
+//
+// Start Raven Receiver with a context aware handler.
+// Context of handler is cancelled when receiver is stopped or message times out.
+//
+func (this *RavenReceiver) StartContext(f ContextHandler) error {
+	return this.Start(AdaptContextHandler(f))
+}
+
 // lock to used to ensure multiple receivers to the same source are not running.
 func (this *RavenReceiver) lockme() error {
 	if this.lock == nil {
@@ -204,6 +379,7 @@ func (this *RavenReceiver) lockme() error {
 	if err := this.lock.Acquire(r); err != nil {
 		return err
 	}
+	this.setLockHeld(true)
 	return nil
 }
 
@@ -213,6 +389,7 @@ func (this *RavenReceiver) unlock() error {
 		return nil
 	}
 	//fmt.Println("unlock")
+	this.setLockHeld(false)
 	if err := this.lock.Release(); err != nil {
 		return err
 	}
@@ -220,6 +397,19 @@ func (this *RavenReceiver) unlock() error {
 	return nil
 }
 
+// check if lock is currently held by this receiver.
+func (this *RavenReceiver) isLockHeld() bool {
+	return atomic.LoadInt32(&this.lockHeld) == 1
+}
+
+func (this *RavenReceiver) setLockHeld(held bool) {
+	var v int32
+	if held {
+		v = 1
+	}
+	atomic.StoreInt32(&this.lockHeld, v)
+}
+
 // ensures that the lock does not dies out, till the receiver is running.
 func (this *RavenReceiver) startLockRefresher() error {
 	if this.lock == nil {
@@ -231,7 +421,9 @@ func (this *RavenReceiver) startLockRefresher() error {
 			func() {
 				//fmt.Println("referesh")
 				defer util.PanicHandler("Lock Refresh failed")
-				if err := this.lock.Refresh(); err != nil {
+				err := this.lock.Refresh()
+				this.setLockHeld(err == nil)
+				if err != nil {
 					fmt.Printf("Lock refresh failed, Error: %s", err.Error())
 				}
 
@@ -257,6 +449,9 @@ func (this *RavenReceiver) validate() error {
 	if len(this.msgReceivers) <= 0 {
 		return fmt.Errorf("Atleast one msg Receiver needs to be assigned")
 	}
+	if this.isGrouped() && this.farm.lockManager == nil {
+		return fmt.Errorf("Group mode needs a lock, attach one to farm using AttachLock")
+	}
 	return nil
 }
 
@@ -278,6 +473,13 @@ func (this *RavenReceiver) GetInFlightRavens() map[string]string {
 	return holder
 }
 
+//
+// Get counts of messages handled by receiver, by message type.
+//
+func (this *RavenReceiver) GetTypeStats() map[string]TypeStats {
+	return this.stats.snapshot()
+}
+
 //
 // Get count of messages sitting in dead box.
 //
@@ -311,6 +513,73 @@ func (this *RavenReceiver) FlushDeadBox() map[string]string {
 	return holder
 }
 
+//
+// Move dead messages matching filter back to their boxes, upto limit if positive.
+// Returns no. of messages replayed.
+//
+func (this *RavenReceiver) ReplayDeadBox(filter DeadFilter, limit int) (int, error) {
+	var replayed int
+	for _, r := range this.msgReceivers {
+		if limit > 0 && replayed >= limit {
+			break
+		}
+		remaining := 0
+		if limit > 0 {
+			remaining = limit - replayed
+		}
+		n, err := r.replayDeadBox(filter, remaining)
+		replayed += n
+		if err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
+//
+// Delete dead messages with the given ids, from box with the given id or from all
+// boxes if box is empty. Returns no. of messages deleted.
+//
+func (this *RavenReceiver) DeleteDead(box string, ids ...string) (int, error) {
+	return this.forDeadIds(box, ids, func(r *MsgReceiver, filter DeadFilter) (int, error) {
+		return r.deleteDead(filter, 0)
+	})
+}
+
+//
+// Move dead messages with the given ids back to their box, from box with the given id
+// or from all boxes if box is empty. Returns no. of messages requeued.
+//
+func (this *RavenReceiver) RequeueDead(box string, ids ...string) (int, error) {
+	return this.forDeadIds(box, ids, func(r *MsgReceiver, filter DeadFilter) (int, error) {
+		return r.replayDeadBox(filter, 0)
+	})
+}
+
+// apply f to dead messages with the given ids, in box with the given id or in all boxes.
+func (this *RavenReceiver) forDeadIds(box string, ids []string,
+	f func(r *MsgReceiver, filter DeadFilter) (int, error)) (int, error) {
+
+	if box != "" && this.getMsgReceiver(box) == nil {
+		return 0, ErrUnknownBox
+	}
+	if len(ids) == 0 {
+		return 0, nil //an empty filter selects all.
+	}
+	var total int
+	for _, r := range this.msgReceivers {
+		if box != "" && r.id != box {
+			continue
+		}
+		n, err := f(r, DeadFilter{Ids: ids})
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
 //
 // Flush all messages from all boxes.
 //
@@ -327,7 +596,8 @@ func (this *RavenReceiver) FlushAll() map[string]string {
 }
 
 //
-// List messages from dead box
+// List messages from dead box, all of them in one go.
+// Use BrowseDeadBox for dead boxes that can grow large.
 //
 func (this *RavenReceiver) ShowDeadBox() ([]*Message, error) {
 	m := make([]*Message, 0)
@@ -342,6 +612,48 @@ func (this *RavenReceiver) ShowDeadBox() ([]*Message, error) {
 	return m, nil
 }
 
+//
+// List dead messages matching filter a page at a time, boxes in order and oldest first
+// within a box. Only the box with given id is listed, unless box is empty.
+// Listing is continued from cursor, if not empty, cursor of next page is returned in page.
+//
+func (this *RavenReceiver) BrowseDeadBox(box string, filter DeadFilter, cursor string, limit int) (DeadPage, error) {
+	page := newDeadPage()
+	if box != "" && this.getMsgReceiver(box) == nil {
+		return page, ErrUnknownBox
+	}
+	//cursor is index of box, followed by cursor within box.
+	start, inner := 0, ""
+	if cursor != "" {
+		parts := strings.SplitN(cursor, ":", 2)
+		var err error
+		if start, err = strconv.Atoi(parts[0]); err != nil || len(parts) != 2 || start < 0 {
+			return page, ErrInvalidCursor
+		}
+		inner = parts[1]
+	}
+	limit = pageLimit(limit)
+	for i := start; i < len(this.msgReceivers); i++ {
+		r := this.msgReceivers[i]
+		if box != "" && r.id != box {
+			inner = ""
+			continue
+		}
+		p, err := r.browseDeadBox(filter, inner, limit-page.size())
+		page.Messages = append(page.Messages, p.Messages...)
+		page.Raw = append(page.Raw, p.Raw...)
+		if err != nil {
+			return page, err
+		}
+		if p.Next != "" {
+			page.Next = fmt.Sprintf("%d:%s", i, p.Next)
+			return page, nil
+		}
+		inner = ""
+	}
+	return page, nil
+}
+
 //
 // A informational message to be shown while booting up receiver.
 //
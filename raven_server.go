@@ -6,7 +6,10 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -98,12 +101,16 @@ func (this *ReceiverHolder) defineRoutes() {
 	this.engine.GET("/", this.ping)
 	this.engine.GET("/ping", this.ping)
 	this.engine.GET("/stats", this.stats)
+	this.engine.GET("/metrics", this.metrics)
 	this.engine.GET("/showDeadBox", this.showDeadBox)
 
 	//kill receiver/restart
 	//show dead messages.
 	this.engine.POST("/flushDead", this.flushDeadQ)
 	this.engine.POST("/flushAll", this.flushAll)
+	this.engine.POST("/replayDead", this.replayDead)
+	this.engine.DELETE("/dead/:id", this.deleteDead)
+	this.engine.POST("/dead/:id/requeue", this.requeueDead)
 }
 
 //called to fetch listener.
@@ -140,10 +147,49 @@ func (this *ReceiverHolder) stats(c *gin.Context) {
 		"Boxes":      boxes,
 		"Inflight":   flightData,
 		"DeadBox":    deadBoxData,
+		"Types":      this.receiver.GetTypeStats(),
 	}
 	c.JSON(200, data)
 }
 
+// metrics router, serves counters of farm and depth of boxes in prometheus text format.
+func (this *ReceiverHolder) metrics(c *gin.Context) {
+	inflight := make(map[string]float64)
+	dead := make(map[string]float64)
+	active := make(map[string]float64)
+	lag := make(map[string]float64)
+	for _, r := range this.receiver.msgReceivers {
+		labels := r.metricLabels()
+		if cc, err := r.getInFlightRavens(); err == nil {
+			inflight[labels] = float64(cc)
+		}
+		if dc, err := r.GetDeadBoxCount(); err == nil {
+			dead[labels] = float64(dc)
+		}
+		lag[labels] = r.GetQueueWait().Seconds()
+		active[labels] = 0
+		if r.isRunning() {
+			active[labels] = 1
+		}
+	}
+	c.Header("Content-Type", "text/plain; version=0.0.4")
+	c.Status(200)
+	this.receiver.farm.WriteMetrics(c.Writer)
+	writeMetric(c.Writer, METRIC_INFLIGHT, "gauge", inflight)
+	writeMetric(c.Writer, METRIC_DEAD, "gauge", dead)
+	writeMetric(c.Writer, METRIC_BOX_ACTIVE, "gauge", active)
+	writeMetric(c.Writer, METRIC_QUEUE_LAG, "gauge", lag)
+	if this.receiver.lock != nil {
+		held := 0.0
+		if this.receiver.isLockHeld() {
+			held = 1
+		}
+		writeMetric(c.Writer, METRIC_LOCK_HELD, "gauge", map[string]float64{
+			label("receiver", this.receiver.GetId()): held,
+		})
+	}
+}
+
 //flushdeadQ router
 func (this *ReceiverHolder) flushDeadQ(c *gin.Context) {
 
@@ -152,6 +198,103 @@ func (this *ReceiverHolder) flushDeadQ(c *gin.Context) {
 	c.JSON(200, data)
 }
 
+//replaydead router, messages are picked by query params
+//id, type (repeated or comma separated), idPrefix, minAge, maxAge (durations like 1h30m),
+//since, until (RFC3339 times of failure), error (substring of last error) and limit.
+func (this *ReceiverHolder) replayDead(c *gin.Context) {
+	filter, err := deadFilterFromQuery(c)
+	if err != nil {
+		c.JSON(400, err.Error())
+		return
+	}
+	limit := 0
+	if v := c.Query("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil {
+			c.JSON(400, fmt.Sprintf("Invalid limit: %s", v))
+			return
+		}
+	}
+	replayed, err := this.receiver.ReplayDeadBox(filter, limit)
+	if err != nil {
+		c.JSON(500, gin.H{"Replayed": replayed, "Error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"Replayed": replayed})
+}
+
+//deletedead router, deletes dead messages with id from box given as query param
+//or from all boxes.
+func (this *ReceiverHolder) deleteDead(c *gin.Context) {
+	deleted, err := this.receiver.DeleteDead(c.Query("box"), c.Param("id"))
+	this.respondDeadById(c, "Deleted", deleted, err)
+}
+
+//requeuedead router, requeues dead messages with id from box given as query param
+//or from all boxes.
+func (this *ReceiverHolder) requeueDead(c *gin.Context) {
+	requeued, err := this.receiver.RequeueDead(c.Query("box"), c.Param("id"))
+	this.respondDeadById(c, "Requeued", requeued, err)
+}
+
+// respond with no. of dead messages acted upon, 404 if there were none.
+func (this *ReceiverHolder) respondDeadById(c *gin.Context, key string, n int, err error) {
+	switch {
+	case err == ErrUnknownBox:
+		c.JSON(400, err.Error())
+	case err != nil:
+		c.JSON(500, gin.H{key: n, "Error": err.Error()})
+	case n == 0:
+		c.JSON(404, gin.H{key: n, "Error": fmt.Sprintf("No dead message with id [%s]", c.Param("id"))})
+	default:
+		c.JSON(200, gin.H{key: n})
+	}
+}
+
+// build filter for dead messages from query params.
+func deadFilterFromQuery(c *gin.Context) (DeadFilter, error) {
+	var filter DeadFilter
+	filter.Ids = queryList(c, "id")
+	filter.Types = queryList(c, "type")
+	filter.Error = c.Query("error")
+	filter.IdPrefix = c.Query("idPrefix")
+	for param, target := range map[string]*time.Duration{"minAge": &filter.MinAge, "maxAge": &filter.MaxAge} {
+		v := c.Query(param)
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return filter, fmt.Errorf("Invalid %s: %s", param, v)
+		}
+		*target = d
+	}
+	for param, target := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		v := c.Query(param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, fmt.Errorf("Invalid %s: %s", param, v)
+		}
+		*target = t
+	}
+	return filter, nil
+}
+
+// values of a query param, supplied repeatedly or comma separated.
+func queryList(c *gin.Context, key string) []string {
+	var list []string
+	for _, v := range c.QueryArray(key) {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
 //flushall router
 func (this *ReceiverHolder) flushAll(c *gin.Context) {
 	responsedata := this.receiver.FlushAll()
@@ -164,12 +307,29 @@ func (this *ReceiverHolder) ping(c *gin.Context) {
 	c.JSON(200, "OK")
 }
 
-//showdead router
+//showdead router, lists a page of dead messages picked by query params of replayDead
+//alongwith box (id of message box), cursor (Next of previous page) and limit.
 func (this *ReceiverHolder) showDeadBox(c *gin.Context) {
-	msgs, err := this.receiver.ShowDeadBox()
+	filter, err := deadFilterFromQuery(c)
+	if err != nil {
+		c.JSON(400, err.Error())
+		return
+	}
+	limit := 0
+	if v := c.Query("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil {
+			c.JSON(400, fmt.Sprintf("Invalid limit: %s", v))
+			return
+		}
+	}
+	page, err := this.receiver.BrowseDeadBox(c.Query("box"), filter, c.Query("cursor"), limit)
+	if err == ErrUnknownBox || err == ErrInvalidCursor {
+		c.JSON(400, err.Error())
+		return
+	}
 	if err != nil {
 		c.JSON(500, err.Error())
 		return
 	}
-	c.JSON(200, msgs)
+	c.JSON(200, page)
 }
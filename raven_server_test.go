@@ -0,0 +1,46 @@
+package raven
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serve path of holder and return the response body.
+func serve(holder *ReceiverHolder, path string) string {
+	w := httptest.NewRecorder()
+	holder.engine.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w.Body.String()
+}
+
+func TestMetricsWhileStopping(t *testing.T) {
+	r := startMemoryReceiver(t, 0, func(m *Message, txn Transaction) error {
+		return nil
+	})
+	holder := &ReceiverHolder{receiver: r.parent, engine: gin.New()}
+	holder.defineRoutes()
+	active := METRIC_BOX_ACTIVE + "{" + r.metricLabels() + "}"
+	if body := serve(holder, "/metrics"); !strings.Contains(body, active+" 1") {
+		t.Fatalf("Expected box to be active, got:\n%s", body)
+	}
+
+	//scraped while box is being stopped.
+	stopped := make(chan bool)
+	go func() {
+		r.stop()
+		close(stopped)
+	}()
+	for done := false; !done; {
+		select {
+		case <-stopped:
+			done = true
+		default:
+			serve(holder, "/metrics")
+		}
+	}
+	if body := serve(holder, "/metrics"); !strings.Contains(body, active+" 0") {
+		t.Errorf("Expected box to be inactive, got:\n%s", body)
+	}
+}
@@ -1,6 +1,7 @@
 package raven
 
 import (
+	"context"
 	"time"
 )
 
@@ -18,6 +19,9 @@ type Raven struct {
 	//To which farm the raven belongs.
 	//This helps in identifying the Farm Manager of Raven.
 	farm *Farm
+
+	//Context of the sender, carries trace of sender to receiver.
+	ctx context.Context
 }
 
 //
@@ -36,10 +40,92 @@ func (this *Raven) SetDestination(d Destination) *Raven {
 	return this
 }
 
+//
+// Define context of the sender, trace of sender is carried alongwith message
+// if a tracer is attached to farm.
+//
+func (this *Raven) SetContext(ctx context.Context) *Raven {
+	this.ctx = ctx
+	return this
+}
+
 //
 // Send Message.
 //
 func (this *Raven) Fly() error {
+	if err := this.validate(); err != nil {
+		return err
+	}
+	// Make it fly
+	this.stamp(time.Now())
+	return this.send(func() error {
+		return this.farm.manager.Send(this.message, this.destination)
+	})
+}
+
+//
+// Send Message, to be delivered at the specified time.
+// Messages are moved to destination once due, by the receivers of destination.
+//
+func (this *Raven) FlyAt(at time.Time) error {
+	if err := this.validate(); err != nil {
+		return err
+	}
+	this.stamp(at)
+	return this.send(func() error {
+		return this.farm.manager.SendAt(this.message, this.destination, at)
+	})
+}
+
+//
+// Send Message, to be delivered after the specified duration.
+//
+func (this *Raven) FlyAfter(d time.Duration) error {
+	return this.FlyAt(time.Now().Add(d))
+}
+
+// stamp message with the time it is sent and becomes available in box.
+func (this *Raven) stamp(enqueueAt time.Time) {
+	stamp(&this.message, enqueueAt)
+}
+
+// stamp message with the time it is sent and becomes available in box.
+// Time of sending is retained for messages being forwarded.
+func stamp(m *Message, enqueueAt time.Time) {
+	now := time.Now()
+	if m.SentAt.IsZero() {
+		m.SentAt = now
+	}
+	if enqueueAt.Before(now) {
+		enqueueAt = now
+	}
+	m.EnqueuedAt = enqueueAt
+}
+
+// send message using f, within span of tracer if one is attached.
+func (this *Raven) send(f func() error) error {
+	if this.farm.tracer == nil {
+		err := f()
+		this.recordSend(err)
+		return err
+	}
+	ctx := this.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	_, end := this.farm.tracer.StartSend(ctx, this.destination.Name, &this.message)
+	err := f()
+	end(err)
+	this.recordSend(err)
+	return err
+}
+
+// record outcome of sending message.
+func (this *Raven) recordSend(err error) {
+	this.farm.recordSend(this.destination.Name, this.message, err)
+}
+
+func (this *Raven) validate() error {
 	//Its a waste of raven if message is empty.
 	if this.message.isEmpty() {
 		return ErrNoMessage
@@ -48,7 +134,5 @@ func (this *Raven) Fly() error {
 	if err := this.destination.Validate(); err != nil {
 		return err
 	}
-	// Make it fly
-	this.message.mtime = time.Now()
-	return this.farm.manager.Send(this.message, this.destination)
+	return nil
 }
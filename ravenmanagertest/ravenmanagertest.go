@@ -0,0 +1,1040 @@
+//
+// Package ravenmanagertest provides a conformance suite for implementations
+// of raven.RavenManager.
+//
+// Any manager, built in or custom, should pass it:
+//
+//	func TestMyManager(t *testing.T) {
+//		ravenmanagertest.Run(t, func(t *testing.T) raven.RavenManager {
+//			return NewMyManager(...)
+//		})
+//	}
+//
+// Factory is called once per test case and must return a manager backed by
+// empty storage. Since some cases wait for Receive to report an empty box,
+// managers should be configured with a short blocking duration.
+//
+package ravenmanagertest
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kukkar/raven"
+)
+
+//
+// Creates a fresh RavenManager for each test case.
+//
+type Factory func(t *testing.T) raven.RavenManager
+
+//
+// A single behavioural test.
+//
+type testCase struct {
+	name     string
+	reliable bool
+	run      func(t *testing.T, h *harness)
+}
+
+var cases = []testCase{
+	{"OrderingWithinBox", false, testOrdering},
+	{"OrderingWithinBoxReliable", true, testOrdering},
+	{"EmptyQueue", false, testEmptyQueue},
+	{"EmptyQueueReliable", true, testEmptyQueue},
+	{"InFlightCount", false, testInFlightCount},
+	{"ShardedBoxes", false, testShardedBoxes},
+	{"MarkProcessed", true, testMarkProcessed},
+	{"RecoveryAfterCrash", true, testRecoveryAfterCrash},
+	{"DeadQueue", true, testDeadQueue},
+	{"Requeue", false, testRequeue},
+	{"RequeueReliable", true, testRequeue},
+	{"FlushDeadQ", true, testFlushDeadQ},
+	{"FlushAll", true, testFlushAll},
+	{"HeadersRoundTrip", true, testHeadersRoundTrip},
+	{"Codecs", true, testCodecs},
+	{"Undecodable", false, testUndecodable},
+	{"UndecodableReliable", true, testUndecodable},
+	{"ScheduledDelivery", false, testScheduledDelivery},
+	{"ScheduledDeliveryReliable", true, testScheduledDelivery},
+	{"DelayMessage", false, testDelayMessage},
+	{"DelayMessageReliable", true, testDelayMessage},
+	{"OutOfOrderAcks", true, testOutOfOrderAcks},
+	{"DuplicateAck", true, testDuplicateAck},
+	{"AckWithoutReceipt", true, testAckWithoutReceipt},
+	{"VisibilityTimeout", true, testVisibilityTimeout},
+	{"ReplayDead", true, testReplayDead},
+	{"DeadFailure", true, testDeadFailure},
+	{"BrowseDead", true, testBrowseDead},
+	{"BrowseDeadWhileRemoving", true, testBrowseDeadWhileRemoving},
+	{"ExpireDead", true, testExpireDead},
+	{"ExpireDeadUnknownAge", true, testExpireDeadUnknownAge},
+	{"DeleteDead", true, testDeleteDead},
+	{"FlyBatch", false, testFlyBatch},
+}
+
+//
+// Run the complete suite against managers produced by factory.
+//
+func Run(t *testing.T, factory Factory) {
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			h := newHarness(t, factory(t), c.reliable)
+			defer h.quit()
+			c.run(t, h)
+		})
+	}
+}
+
+//
+// Test harness wiring a manager with a farm and receivers.
+//
+type harness struct {
+	t        *testing.T
+	manager  raven.RavenManager
+	farm     *raven.Farm
+	receiver *raven.RavenReceiver
+	dest     raven.Destination
+	reliable bool
+}
+
+const queueName = "conformance"
+
+func newHarness(t *testing.T, manager raven.RavenManager, reliable bool) *harness {
+	return newShardedHarness(t, manager, reliable, 1)
+}
+
+func newShardedHarness(t *testing.T, manager raven.RavenManager, reliable bool, boxes int) *harness {
+	farm := raven.InitializeFarmWithManager(manager, nil)
+	receiver, err := farm.GetRavenReceiver(queueName, raven.CreateSource(queueName, boxes))
+	if err != nil {
+		t.Fatalf("Could not create receiver: %s", err)
+	}
+	if reliable {
+		receiver.MarkReliable()
+	}
+	h := &harness{
+		t:        t,
+		manager:  manager,
+		farm:     farm,
+		receiver: receiver,
+		dest:     raven.CreateDestination(queueName, boxes, nil),
+		reliable: reliable,
+	}
+	for _, r := range receiver.GetMsgReceivers() {
+		h.preStartup(r)
+	}
+	return h
+}
+
+// first message receiver.
+func (this *harness) box() raven.MsgReceiver {
+	return *this.receiver.GetMsgReceivers()[0]
+}
+
+func (this *harness) quit() {
+	this.manager.Quit(this.box())
+}
+
+func (this *harness) send(data ...string) []raven.Message {
+	msgs := make([]raven.Message, 0, len(data))
+	for _, d := range data {
+		m := raven.PrepareMessage("", "", d, "")
+		if err := this.manager.Send(m, this.dest); err != nil {
+			this.t.Fatalf("Send failed: %s", err)
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+// send a message with id and move it to dead box, as failed at the given time.
+func (this *harness) kill(id string, failedAt time.Time) {
+	if err := this.manager.Send(raven.PrepareMessage(id, "", id, "key"), this.dest); err != nil {
+		this.t.Fatalf("Send failed: %s", err)
+	}
+	m := this.receive(this.box())
+	m.Failure = &raven.Failure{LastError: "failed", FailedAt: failedAt}
+	if err := this.manager.MarkFailed(m, this.box()); err != nil {
+		this.t.Fatalf("MarkFailed failed: %s", err)
+	}
+}
+
+// first message receiver crashes and comes back a while later, once messages it left are idle.
+func (this *harness) restart() {
+	time.Sleep(10 * time.Millisecond)
+	this.preStartup(this.receiver.GetMsgReceivers()[0])
+}
+
+func (this *harness) preStartup(r *raven.MsgReceiver) {
+	if err := this.manager.PreStartup(*r); err != nil {
+		this.t.Fatalf("PreStartup failed: %s", err)
+	}
+}
+
+func (this *harness) receive(r raven.MsgReceiver) *raven.Message {
+	m, err := this.manager.Receive(r)
+	if err != nil {
+		this.t.Fatalf("Receive failed: %s", err)
+	}
+	if m == nil {
+		this.t.Fatalf("Receive returned nil message without error")
+	}
+	return m
+}
+
+func (this *harness) expectEmpty(r raven.MsgReceiver) {
+	m, err := this.manager.Receive(r)
+	if err != raven.ErrEmptyQueue {
+		this.t.Fatalf("Expected ErrEmptyQueue, got message: %v error: %v", m, err)
+	}
+}
+
+func (this *harness) expectInFlight(r raven.MsgReceiver, expected int) {
+	count, err := this.manager.InFlightMessages(r)
+	if err != nil {
+		this.t.Fatalf("InFlightMessages failed: %s", err)
+	}
+	if count != expected {
+		this.t.Fatalf("Expected %d in flight messages, got %d", expected, count)
+	}
+}
+
+func (this *harness) expectDead(r raven.MsgReceiver, expected int) {
+	count, err := this.manager.GetDeadQCount(r)
+	if err != nil {
+		this.t.Fatalf("GetDeadQCount failed: %s", err)
+	}
+	if count != expected {
+		this.t.Fatalf("Expected %d dead messages, got %d", expected, count)
+	}
+	msgs, err := this.manager.ShowDeadQ(r)
+	if err != nil {
+		this.t.Fatalf("ShowDeadQ failed: %s", err)
+	}
+	if len(msgs) != expected {
+		this.t.Fatalf("Expected ShowDeadQ to list %d messages, got %d", expected, len(msgs))
+	}
+}
+
+func expectMessage(t *testing.T, got *raven.Message, expected raven.Message) {
+	if got.Id != expected.Id || got.Type != expected.Type || got.Data != expected.Data ||
+		got.ShardKey != expected.ShardKey || len(got.Headers) != len(expected.Headers) ||
+		!bytes.Equal(got.Payload, expected.Payload) || got.Attempts != expected.Attempts ||
+		!got.SentAt.Equal(expected.SentAt) || !got.EnqueuedAt.Equal(expected.EnqueuedAt) {
+		t.Fatalf("Expected message %s, got %s", expected, got)
+	}
+	for k, v := range expected.Headers {
+		if got.GetHeader(k) != v {
+			t.Fatalf("Expected header %s to be %s, got %s", k, v, got.GetHeader(k))
+		}
+	}
+	expectFailure(t, got.Failure, expected.Failure)
+}
+
+func expectFailure(t *testing.T, got *raven.Failure, expected *raven.Failure) {
+	if got == nil || expected == nil {
+		if got != expected {
+			t.Fatalf("Expected failure %v, got %v", expected, got)
+		}
+		return
+	}
+	if got.LastError != expected.LastError || got.Attempts != expected.Attempts ||
+		got.Receiver != expected.Receiver || got.Box != expected.Box ||
+		!got.FailedAt.Equal(expected.FailedAt) || len(got.Errors) != len(expected.Errors) {
+		t.Fatalf("Expected failure %v, got %v", *expected, *got)
+	}
+	for i, e := range expected.Errors {
+		if got.Errors[i].Attempt != e.Attempt || got.Errors[i].Error != e.Error || !got.Errors[i].At.Equal(e.At) {
+			t.Fatalf("Expected error %v in history, got %v", e, got.Errors[i])
+		}
+	}
+}
+
+//
+// Test cases sit below.
+//
+
+// messages of a box are received in the order they were sent.
+func testOrdering(t *testing.T, h *harness) {
+	sent := h.send("one", "two", "three")
+	for _, m := range sent {
+		got := h.receive(h.box())
+		expectMessage(t, got, m)
+		if err := h.manager.MarkProcessed(got, h.box()); err != nil {
+			t.Fatalf("MarkProcessed failed: %s", err)
+		}
+	}
+	h.expectEmpty(h.box())
+}
+
+// receiving from an empty box reports ErrEmptyQueue.
+func testEmptyQueue(t *testing.T, h *harness) {
+	h.expectEmpty(h.box())
+	h.expectInFlight(h.box(), 0)
+}
+
+// messages sent but not yet received are in flight.
+func testInFlightCount(t *testing.T, h *harness) {
+	h.send("one", "two", "three")
+	h.expectInFlight(h.box(), 3)
+	h.receive(h.box())
+	h.expectInFlight(h.box(), 2)
+}
+
+// messages are delivered to the box chosen by destination's shard logic, and
+// to none other.
+func testShardedBoxes(t *testing.T, h *harness) {
+	h = newShardedHarness(t, h.manager, false, 3)
+	expected := make(map[string][]raven.Message)
+	for i := 0; i < 12; i++ {
+		m := h.send(fmt.Sprintf("message-%d", i))[0]
+		box, err := h.dest.GetBox4Msg(m)
+		if err != nil {
+			t.Fatalf("GetBox4Msg failed: %s", err)
+		}
+		expected[box.GetName()] = append(expected[box.GetName()], m)
+	}
+	for _, r := range h.receiver.GetMsgReceivers() {
+		box := r.GetMsgBox()
+		h.expectInFlight(*r, len(expected[box.GetName()]))
+		for _, m := range expected[box.GetName()] {
+			expectMessage(t, h.receive(*r), m)
+		}
+		h.expectEmpty(*r)
+	}
+}
+
+// processed messages are not redelivered, even after restart.
+func testMarkProcessed(t *testing.T, h *harness) {
+	h.send("one")
+	m := h.receive(h.box())
+	if err := h.manager.MarkProcessed(m, h.box()); err != nil {
+		t.Fatalf("MarkProcessed failed: %s", err)
+	}
+	h.restart()
+	h.expectEmpty(h.box())
+	h.expectDead(h.box(), 0)
+}
+
+// messages received but neither processed nor failed, are redelivered once
+// receiver restarts.
+func testRecoveryAfterCrash(t *testing.T, h *harness) {
+	sent := h.send("one", "two")
+	expectMessage(t, h.receive(h.box()), sent[0])
+
+	//receiver crashes here and comes back.
+	h.restart()
+
+	got := []*raven.Message{h.receive(h.box()), h.receive(h.box())}
+	for _, m := range got {
+		if err := h.manager.MarkProcessed(m, h.box()); err != nil {
+			t.Fatalf("MarkProcessed failed: %s", err)
+		}
+	}
+	expectMessage(t, got[0], sent[0])
+	expectMessage(t, got[1], sent[1])
+	h.expectEmpty(h.box())
+}
+
+// failed messages move to dead box and are not redelivered.
+func testDeadQueue(t *testing.T, h *harness) {
+	sent := h.send("one")
+	m := h.receive(h.box())
+	if err := h.manager.MarkFailed(m, h.box()); err != nil {
+		t.Fatalf("MarkFailed failed: %s", err)
+	}
+	h.expectDead(h.box(), 1)
+	dead, _ := h.manager.ShowDeadQ(h.box())
+	expectMessage(t, dead[0], sent[0])
+
+	h.restart()
+	h.expectEmpty(h.box())
+	h.expectInFlight(h.box(), 0)
+}
+
+// requeued messages are delivered again, exactly once.
+func testRequeue(t *testing.T, h *harness) {
+	sent := h.send("one", "two")
+	m := h.receive(h.box())
+	expectMessage(t, m, sent[0])
+	if err := h.manager.RequeMessage(*m, h.box()); err != nil {
+		t.Fatalf("RequeMessage failed: %s", err)
+	}
+	seen := make(map[string]int)
+	for i := 0; i < 2; i++ {
+		m := h.receive(h.box())
+		seen[m.Id]++
+		if err := h.manager.MarkProcessed(m, h.box()); err != nil {
+			t.Fatalf("MarkProcessed failed: %s", err)
+		}
+	}
+	for _, m := range sent {
+		if seen[m.Id] != 1 {
+			t.Fatalf("Expected message %s to be received once, got %d", m, seen[m.Id])
+		}
+	}
+	h.restart()
+	h.expectEmpty(h.box())
+}
+
+// flushing dead box removes only dead messages.
+func testFlushDeadQ(t *testing.T, h *harness) {
+	h.send("one", "two")
+	m := h.receive(h.box())
+	if err := h.manager.MarkFailed(m, h.box()); err != nil {
+		t.Fatalf("MarkFailed failed: %s", err)
+	}
+	h.expectDead(h.box(), 1)
+	if err := h.manager.FlushDeadQ(h.box()); err != nil {
+		t.Fatalf("FlushDeadQ failed: %s", err)
+	}
+	h.expectDead(h.box(), 0)
+	h.expectInFlight(h.box(), 1)
+}
+
+// flushing all removes in flight, processing and dead messages.
+func testFlushAll(t *testing.T, h *harness) {
+	h.send("one", "two", "three")
+	m := h.receive(h.box())
+	if err := h.manager.MarkFailed(m, h.box()); err != nil {
+		t.Fatalf("MarkFailed failed: %s", err)
+	}
+	h.receive(h.box()) //left in processing.
+
+	if err := h.manager.FlushAll(h.box()); err != nil {
+		t.Fatalf("FlushAll failed: %s", err)
+	}
+	h.expectInFlight(h.box(), 0)
+	h.expectDead(h.box(), 0)
+	h.restart()
+	h.expectEmpty(h.box())
+}
+
+// headers survive send, receive and dead box.
+func testHeadersRoundTrip(t *testing.T, h *harness) {
+	m := raven.PrepareMessage("", "", "one", "",
+		raven.WithHeader("trace-id", "abc"),
+		raven.WithHeaders(map[string]string{"tenant": "t1", "content-type": "application/json"}),
+	)
+	if err := h.manager.Send(m, h.dest); err != nil {
+		t.Fatalf("Send failed: %s", err)
+	}
+	got := h.receive(h.box())
+	expectMessage(t, got, m)
+	if err := h.manager.MarkFailed(got, h.box()); err != nil {
+		t.Fatalf("MarkFailed failed: %s", err)
+	}
+	dead, err := h.manager.ShowDeadQ(h.box())
+	if err != nil || len(dead) != 1 {
+		t.Fatalf("Expected one dead message, got %d, error: %v", len(dead), err)
+	}
+	expectMessage(t, dead[0], m)
+}
+
+// binary payloads survive every codec, for managers supporting them.
+func testCodecs(t *testing.T, h *harness) {
+	if _, ok := h.manager.(raven.CodecAware); !ok {
+		t.Skip("Manager does not support pluggable codecs")
+	}
+	codecs := []raven.Codec{raven.JsonCodec{}, raven.MsgpackCodec{}, raven.ProtobufCodec{}}
+	for _, codec := range codecs {
+		if err := h.farm.SetCodec(codec); err != nil {
+			t.Fatalf("SetCodec failed: %s", err)
+		}
+		m := raven.PrepareBinaryMessage("", "bin", []byte{0x00, 0xff, 0xfe, 'r', 0x80}, "",
+			raven.WithHeader("content-type", "application/octet-stream"),
+		)
+		m.Attempts = 2
+		m.SentAt = time.Unix(1500000000, 123456789)
+		m.EnqueuedAt = time.Unix(1600000000, 987654321)
+		m.Failure = deadFailure()
+		if err := h.manager.Send(m, h.dest); err != nil {
+			t.Fatalf("Send using %s failed: %s", codec.Name(), err)
+		}
+		got := h.receive(h.box())
+		expectMessage(t, got, m)
+		if err := h.manager.MarkProcessed(got, h.box()); err != nil {
+			t.Fatalf("MarkProcessed failed: %s", err)
+		}
+	}
+}
+
+// messages sent using another codec are not handed over, reliable receivers move them to dead box.
+func testUndecodable(t *testing.T, h *harness) {
+	if _, ok := h.manager.(raven.CodecAware); !ok {
+		t.Skip("Manager does not support pluggable codecs")
+	}
+	if err := h.farm.SetCodec(raven.ProtobufCodec{}); err != nil {
+		t.Fatalf("SetCodec failed: %s", err)
+	}
+	h.send("sent as protobuf")
+	if err := h.farm.SetCodec(raven.JsonCodec{}); err != nil {
+		t.Fatalf("SetCodec failed: %s", err)
+	}
+	if m, err := h.manager.Receive(h.box()); err != raven.ErrUndecodable {
+		t.Fatalf("Expected ErrUndecodable, got message: %v error: %v", m, err)
+	}
+	h.expectEmpty(h.box())
+	if !h.reliable {
+		return
+	}
+	count, err := h.manager.GetDeadQCount(h.box())
+	if err != nil {
+		t.Fatalf("GetDeadQCount failed: %s", err)
+	}
+	if count != 1 {
+		t.Fatalf("Expected undecodable message in dead box, got %d dead messages", count)
+	}
+	page, err := h.manager.BrowseDeadQ(h.box(), raven.DeadFilter{}, "", 0)
+	if err != nil {
+		t.Fatalf("BrowseDeadQ failed: %s", err)
+	}
+	if len(page.Raw) != 1 || len(page.Messages) != 0 {
+		t.Fatalf("Expected undecodable message listed as raw, got %d raw and %d messages", len(page.Raw), len(page.Messages))
+	}
+	//message is decoded once codec is restored.
+	if err := h.farm.SetCodec(raven.ProtobufCodec{}); err != nil {
+		t.Fatalf("SetCodec failed: %s", err)
+	}
+	page, err = h.manager.BrowseDeadQ(h.box(), raven.DeadFilter{}, "", 0)
+	if err != nil {
+		t.Fatalf("BrowseDeadQ failed: %s", err)
+	}
+	if len(page.Messages) != 1 || page.Messages[0].Data != "sent as protobuf" {
+		t.Fatalf("Expected dead message to be decoded using its codec, got %+v", page)
+	}
+}
+
+func testScheduledDelivery(t *testing.T, h *harness) {
+	m := raven.PrepareMessage("", "", "due", "")
+	later := raven.PrepareMessage("", "", "later", "")
+	//identical messages, both should be delivered.
+	for i := 0; i < 2; i++ {
+		if err := h.manager.SendAt(m, h.dest, time.Now().Add(-time.Second)); err != nil {
+			t.Fatalf("SendAt failed: %s", err)
+		}
+	}
+	if err := h.manager.SendAt(later, h.dest, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("SendAt failed: %s", err)
+	}
+	// nothing is delivered until promoted.
+	h.expectEmpty(h.box())
+
+	n, err := h.manager.PromoteScheduled(h.box())
+	if err != nil {
+		t.Fatalf("PromoteScheduled failed: %s", err)
+	}
+	if n != 2 {
+		t.Fatalf("Expected 2 messages to be promoted, got %d", n)
+	}
+	h.expectInFlight(h.box(), 2)
+	expectMessage(t, h.receive(h.box()), m)
+	expectMessage(t, h.receive(h.box()), m)
+	h.expectEmpty(h.box())
+
+	// message not yet due stays scheduled.
+	if n, err := h.manager.PromoteScheduled(h.box()); err != nil || n != 0 {
+		t.Fatalf("Expected no messages to be promoted, got %d, error: %v", n, err)
+	}
+}
+
+func testDelayMessage(t *testing.T, h *harness) {
+	h.send("one")
+	got := h.receive(h.box())
+	got.Attempts++
+	if err := h.manager.DelayMessage(*got, h.box(), time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("DelayMessage failed: %s", err)
+	}
+	// delayed message is no longer pending processing.
+	h.restart()
+	h.expectEmpty(h.box())
+
+	if n, err := h.manager.PromoteScheduled(h.box()); err != nil || n != 1 {
+		t.Fatalf("Expected 1 message to be promoted, got %d, error: %v", n, err)
+	}
+	expectMessage(t, h.receive(h.box()), *got)
+}
+
+// acks of concurrent workers arrive in any order.
+func testOutOfOrderAcks(t *testing.T, h *harness) {
+	sent := h.send("one", "two", "three")
+	one, two, three := h.receive(h.box()), h.receive(h.box()), h.receive(h.box())
+
+	if err := h.manager.MarkProcessed(three, h.box()); err != nil {
+		t.Fatalf("MarkProcessed failed: %s", err)
+	}
+	if err := h.manager.MarkFailed(two, h.box()); err != nil {
+		t.Fatalf("MarkFailed failed: %s", err)
+	}
+	if err := h.manager.RequeMessage(*one, h.box()); err != nil {
+		t.Fatalf("RequeMessage failed: %s", err)
+	}
+	got := h.receive(h.box())
+	expectMessage(t, got, sent[0])
+	if err := h.manager.MarkProcessed(got, h.box()); err != nil {
+		t.Fatalf("MarkProcessed failed: %s", err)
+	}
+
+	// nothing is left pending processing.
+	h.restart()
+	h.expectEmpty(h.box())
+	h.expectDead(h.box(), 1)
+	dead, _ := h.manager.ShowDeadQ(h.box())
+	expectMessage(t, dead[0], sent[1])
+}
+
+// every delivery of identical messages is acked on its own.
+func testDuplicateAck(t *testing.T, h *harness) {
+	m := raven.PrepareMessage("", "", "same", "")
+	for i := 0; i < 2; i++ {
+		if err := h.manager.Send(m, h.dest); err != nil {
+			t.Fatalf("Send failed: %s", err)
+		}
+	}
+	first := h.receive(h.box())
+	h.receive(h.box())
+	for i := 0; i < 2; i++ {
+		if err := h.manager.MarkProcessed(first, h.box()); err != nil {
+			t.Fatalf("MarkProcessed failed: %s", err)
+		}
+	}
+	// second delivery is still pending and recovered.
+	h.restart()
+	expectMessage(t, h.receive(h.box()), m)
+	h.expectEmpty(h.box())
+}
+
+func testAckWithoutReceipt(t *testing.T, h *harness) {
+	h.send("one")
+	h.receive(h.box())
+	m := raven.PrepareMessage("", "", "one", "")
+	if err := h.manager.MarkProcessed(&m, h.box()); err != raven.ErrInvalidReceipt {
+		t.Fatalf("Expected ErrInvalidReceipt on MarkProcessed, got: %v", err)
+	}
+	if err := h.manager.MarkFailed(&m, h.box()); err != raven.ErrInvalidReceipt {
+		t.Fatalf("Expected ErrInvalidReceipt on MarkFailed, got: %v", err)
+	}
+	if err := h.manager.RequeMessage(m, h.box()); err != raven.ErrInvalidReceipt {
+		t.Fatalf("Expected ErrInvalidReceipt on RequeMessage, got: %v", err)
+	}
+	h.expectInFlight(h.box(), 0)
+	h.expectDead(h.box(), 0)
+}
+
+func testVisibilityTimeout(t *testing.T, h *harness) {
+	const timeout = 200 * time.Millisecond
+	h.receiver.SetVisibilityTimeout(timeout, 2)
+	reap := func(expected int) {
+		n, err := h.manager.ReapExpired(h.box())
+		if err != nil {
+			t.Fatalf("ReapExpired failed: %s", err)
+		}
+		if n != expected {
+			t.Fatalf("Expected %d messages to be reaped, got %d", expected, n)
+		}
+	}
+	sent := h.send("one")
+	h.receive(h.box())
+	reap(0)
+
+	// first expiry returns message to box.
+	time.Sleep(timeout + 100*time.Millisecond)
+	reap(1)
+	expectMessage(t, h.receive(h.box()), sent[0])
+	h.expectDead(h.box(), 0)
+
+	// second one moves it to dead box, recording expiries as its failure.
+	time.Sleep(timeout + 100*time.Millisecond)
+	reap(1)
+	h.expectEmpty(h.box())
+	h.expectDead(h.box(), 1)
+	dead, err := h.manager.ShowDeadQ(h.box())
+	if err != nil {
+		t.Fatalf("ShowDeadQ failed: %s", err)
+	}
+	failure := dead[0].Failure
+	if dead[0].Id != sent[0].Id || failure == nil {
+		t.Fatalf("Expected message %s to carry failure, got %s", sent[0], dead[0])
+	}
+	if failure.LastError != "visibility timeout expired 2 times" || failure.Attempts != 1 ||
+		len(failure.Errors) != 1 || failure.Receiver != queueName || failure.Box == "" || failure.FailedAt.IsZero() {
+		t.Fatalf("Unexpected failure of expired message %+v", *failure)
+	}
+}
+
+// dead messages matching filter are moved back to box, oldest first.
+func testReplayDead(t *testing.T, h *harness) {
+	old := raven.PrepareMessage("", "order", "old", "")
+	old.SentAt = time.Now().Add(-2 * time.Hour)
+	old.Attempts = 3
+	fresh := raven.PrepareMessage("", "order", "fresh", "")
+	fresh.SentAt = time.Now()
+	other := raven.PrepareMessage("", "invoice", "other", "")
+	for _, m := range []raven.Message{old, fresh, other} {
+		if err := h.manager.Send(m, h.dest); err != nil {
+			t.Fatalf("Send failed: %s", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if err := h.manager.MarkFailed(h.receive(h.box()), h.box()); err != nil {
+			t.Fatalf("MarkFailed failed: %s", err)
+		}
+	}
+	h.expectDead(h.box(), 3)
+
+	replay := func(filter raven.DeadFilter, limit int, expected int) {
+		n, err := h.manager.ReplayDead(h.box(), filter, limit)
+		if err != nil {
+			t.Fatalf("ReplayDead failed: %s", err)
+		}
+		if n != expected {
+			t.Fatalf("Expected %d messages to be replayed, got %d", expected, n)
+		}
+	}
+	expectReplayed := func(expected raven.Message) {
+		got := h.receive(h.box())
+		if got.Id != expected.Id || got.Data != expected.Data {
+			t.Fatalf("Expected message %s, got %s", expected, got)
+		}
+		if got.Attempts != 0 {
+			t.Fatalf("Expected attempts of replayed message to be reset, got %d", got.Attempts)
+		}
+		if err := h.manager.MarkProcessed(got, h.box()); err != nil {
+			t.Fatalf("MarkProcessed failed: %s", err)
+		}
+	}
+
+	replay(raven.DeadFilter{Types: []string{"order"}, MinAge: time.Hour}, 0, 1)
+	h.expectDead(h.box(), 2)
+	expectReplayed(old)
+
+	// oldest dead message goes first.
+	replay(raven.DeadFilter{}, 1, 1)
+	replay(raven.DeadFilter{Ids: []string{other.Id}}, 0, 1)
+	h.expectDead(h.box(), 0)
+	replay(raven.DeadFilter{}, 0, 0)
+	expectReplayed(fresh)
+	expectReplayed(other)
+	h.expectEmpty(h.box())
+}
+
+// failure of a message as recorded by receiver, while moving it to dead box.
+func deadFailure() *raven.Failure {
+	return &raven.Failure{
+		LastError: "permanent: stack trace follows",
+		Errors: []raven.AttemptError{
+			{Attempt: 1, Error: "timeout", At: time.Unix(1600000001, 1)},
+			{Attempt: 2, Error: "permanent: stack trace follows", At: time.Unix(1600000002, 2)},
+		},
+		Attempts: 2,
+		Receiver: "orders",
+		Box:      "orders-1",
+		FailedAt: time.Unix(1600000003, 3),
+	}
+}
+
+// failure of message is kept in dead box and dead messages can be picked by it.
+func testDeadFailure(t *testing.T, h *harness) {
+	sent := h.send("one", "two")
+	for _, reason := range []string{"permanent", "invalid payload"} {
+		m := h.receive(h.box())
+		m.Failure = deadFailure()
+		m.Failure.LastError = reason
+		if err := h.manager.MarkFailed(m, h.box()); err != nil {
+			t.Fatalf("MarkFailed failed: %s", err)
+		}
+	}
+	h.expectDead(h.box(), 2)
+	dead, err := h.manager.ShowDeadQ(h.box())
+	if err != nil {
+		t.Fatalf("ShowDeadQ failed: %s", err)
+	}
+	expected := sent[1]
+	expected.Failure = deadFailure()
+	expected.Failure.LastError = "invalid payload"
+	found := false
+	for _, m := range dead {
+		if m.Id == expected.Id {
+			expectMessage(t, m, expected)
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("Expected message %s in dead box", expected)
+	}
+
+	n, err := h.manager.ReplayDead(h.box(), raven.DeadFilter{Error: "payload"}, 0)
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1 message to be replayed, got %d, err: %v", n, err)
+	}
+	got := h.receive(h.box())
+	if got.Id != expected.Id || got.Failure == nil || got.Failure.LastError != "invalid payload" {
+		t.Fatalf("Expected replayed message %s to keep its failure, got %s", expected, got)
+	}
+	h.expectDead(h.box(), 1)
+}
+
+// dead messages are listed a page at a time, oldest first, and can be filtered.
+func testBrowseDead(t *testing.T, h *harness) {
+	failedAt := time.Unix(1600000000, 0)
+	kill := func(ids ...string) {
+		for _, id := range ids {
+			failedAt = failedAt.Add(time.Minute)
+			h.kill(id, failedAt)
+		}
+	}
+	kill("a-1", "a-2", "a-3", "b-1", "b-2")
+
+	var listed []string
+	box := h.box()
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatalf("Expected browsing to end, got %v", listed)
+		}
+		page, err := h.receiver.BrowseDeadBox(box.GetId(), raven.DeadFilter{}, cursor, 2)
+		if err != nil {
+			t.Fatalf("BrowseDeadBox failed: %s", err)
+		}
+		if len(page.Messages) > 2 {
+			t.Fatalf("Expected at most 2 messages in a page, got %d", len(page.Messages))
+		}
+		for _, m := range page.Messages {
+			listed = append(listed, m.Id)
+		}
+		//messages dying meanwhile, are listed at the end.
+		if pages == 0 {
+			kill("c-1")
+		}
+		if cursor = page.Next; cursor == "" {
+			break
+		}
+	}
+	if strings.Join(listed, ",") != "a-1,a-2,a-3,b-1,b-2,c-1" {
+		t.Fatalf("Expected dead messages to be listed oldest first, got %v", listed)
+	}
+
+	browse := func(filter raven.DeadFilter, expected string) {
+		page, err := h.manager.BrowseDeadQ(h.box(), filter, "", 0)
+		if err != nil {
+			t.Fatalf("BrowseDeadQ failed: %s", err)
+		}
+		ids := make([]string, 0, len(page.Messages))
+		for _, m := range page.Messages {
+			ids = append(ids, m.Id)
+		}
+		if strings.Join(ids, ",") != expected || page.Next != "" {
+			t.Fatalf("Expected %s to be listed, got %v, next: %s", expected, ids, page.Next)
+		}
+	}
+	browse(raven.DeadFilter{IdPrefix: "b-"}, "b-1,b-2")
+	start := time.Unix(1600000000, 0)
+	browse(raven.DeadFilter{Since: start.Add(2 * time.Minute), Until: start.Add(3 * time.Minute)}, "a-2,a-3")
+	browse(raven.DeadFilter{Error: "none such"}, "")
+
+	if _, err := h.receiver.BrowseDeadBox("none", raven.DeadFilter{}, "", 0); err != raven.ErrUnknownBox {
+		t.Fatalf("Expected ErrUnknownBox, got %v", err)
+	}
+}
+
+// messages removed between pages do not make browsing skip others.
+func testBrowseDeadWhileRemoving(t *testing.T, h *harness) {
+	failedAt := time.Unix(1600000000, 0)
+	for _, id := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		failedAt = failedAt.Add(time.Minute)
+		h.kill(id, failedAt)
+	}
+	var listed []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatalf("Expected browsing to end, got %v", listed)
+		}
+		page, err := h.receiver.BrowseDeadBox("", raven.DeadFilter{}, cursor, 2)
+		if err != nil {
+			t.Fatalf("BrowseDeadBox failed: %s", err)
+		}
+		ids := make([]string, 0, len(page.Messages))
+		for _, m := range page.Messages {
+			ids = append(ids, m.Id)
+		}
+		listed = append(listed, ids...)
+		switch pages {
+		case 0:
+			//messages listed are deleted.
+			if _, err := h.manager.DeleteDead(h.box(), raven.DeadFilter{Ids: ids}, 0); err != nil {
+				t.Fatalf("DeleteDead failed: %s", err)
+			}
+		case 1:
+			//last message listed and one yet to be listed are replayed.
+			if _, err := h.manager.ReplayDead(h.box(), raven.DeadFilter{Ids: []string{"d", "f"}}, 0); err != nil {
+				t.Fatalf("ReplayDead failed: %s", err)
+			}
+		}
+		if cursor = page.Next; cursor == "" {
+			break
+		}
+	}
+	if strings.Join(listed, ",") != "a,b,c,d,e,g" {
+		t.Fatalf("Expected no message to be skipped, got %v", listed)
+	}
+}
+
+// archive collecting ids of messages, failing while err is set.
+type archive struct {
+	ids []string
+	err error
+}
+
+func (this *archive) Archive(box string, page raven.DeadPage) error {
+	if this.err != nil {
+		return this.err
+	}
+	for _, m := range page.Messages {
+		this.ids = append(this.ids, m.Id)
+	}
+	return nil
+}
+
+// dead messages exceeding retention are archived and removed, oldest first.
+func testExpireDead(t *testing.T, h *harness) {
+	now := time.Now()
+	h.kill("old-1", now.Add(-3*time.Hour))
+	h.kill("old-2", now.Add(-2*time.Hour))
+	for _, id := range []string{"new-1", "new-2", "new-3"} {
+		h.kill(id, now)
+	}
+	a := &archive{err: fmt.Errorf("disk full")}
+	retention := raven.DeadRetention{MaxAge: time.Hour, MaxCount: 2, Archive: a}
+
+	// nothing is removed unless archived.
+	if n, err := h.manager.ExpireDead(h.box(), retention); err == nil || n != 0 {
+		t.Fatalf("Expected ExpireDead to fail with archive, got %d removed, err: %v", n, err)
+	}
+	h.expectDead(h.box(), 5)
+
+	a.err = nil
+	n, err := h.manager.ExpireDead(h.box(), retention)
+	if err != nil {
+		t.Fatalf("ExpireDead failed: %s", err)
+	}
+	if n != 3 || strings.Join(a.ids, ",") != "old-1,old-2,new-1" {
+		t.Fatalf("Expected old-1,old-2,new-1 to be removed, got %d removed, archived: %v", n, a.ids)
+	}
+	h.expectDead(h.box(), 2)
+
+	// within retention now.
+	if n, err := h.manager.ExpireDead(h.box(), retention); err != nil || n != 0 {
+		t.Fatalf("Expected nothing to be removed, got %d, err: %v", n, err)
+	}
+}
+
+// dead messages of unknown age do not hold back expiry of others, they are removed only over MaxCount.
+func testExpireDeadUnknownAge(t *testing.T, h *harness) {
+	now := time.Now()
+	h.kill("unknown", time.Time{})
+	h.kill("old-1", now.Add(-3*time.Hour))
+	h.kill("old-2", now.Add(-2*time.Hour))
+	h.kill("new-1", now)
+
+	expire := func(retention raven.DeadRetention, expected string, left int) {
+		a := &archive{}
+		retention.Archive = a
+		n, err := h.manager.ExpireDead(h.box(), retention)
+		if err != nil {
+			t.Fatalf("ExpireDead failed: %s", err)
+		}
+		if strings.Join(a.ids, ",") != expected || n != len(a.ids) {
+			t.Fatalf("Expected %s to be removed, got %d removed, archived: %v", expected, n, a.ids)
+		}
+		h.expectDead(h.box(), left)
+	}
+	expire(raven.DeadRetention{MaxAge: time.Hour}, "old-1,old-2", 2)
+	expire(raven.DeadRetention{MaxAge: time.Hour}, "", 2)
+	expire(raven.DeadRetention{MaxAge: time.Hour, MaxCount: 1}, "unknown", 1)
+}
+
+// dead messages are deleted selectively, leaving others as is.
+func testDeleteDead(t *testing.T, h *harness) {
+	now := time.Now()
+	for _, id := range []string{"a", "b", "b", "c"} {
+		h.kill(id, now)
+	}
+	deleteDead := func(filter raven.DeadFilter, limit int, expected int) {
+		n, err := h.manager.DeleteDead(h.box(), filter, limit)
+		if err != nil {
+			t.Fatalf("DeleteDead failed: %s", err)
+		}
+		if n != expected {
+			t.Fatalf("Expected %d messages to be deleted, got %d", expected, n)
+		}
+	}
+	deleteDead(raven.DeadFilter{Ids: []string{"b"}}, 1, 1)
+	h.expectDead(h.box(), 3)
+	deleteDead(raven.DeadFilter{Ids: []string{"b", "none"}}, 0, 1)
+	deleteDead(raven.DeadFilter{Ids: []string{"b"}}, 0, 0)
+	h.expectDead(h.box(), 2)
+
+	dead, err := h.manager.ShowDeadQ(h.box())
+	if err != nil {
+		t.Fatalf("ShowDeadQ failed: %s", err)
+	}
+	for _, m := range dead {
+		if m.Id != "a" && m.Id != "c" {
+			t.Fatalf("Expected only a and c to be left in dead box, got %s", m)
+		}
+	}
+	h.expectEmpty(h.box())
+}
+
+// messages sent in bulk reach their boxes in order, errors are reported per message.
+func testFlyBatch(t *testing.T, h *harness) {
+	h = newShardedHarness(t, h.manager, false, 3)
+	msgs := make([]raven.Message, 0)
+	for i := 0; i < 12; i++ {
+		msgs = append(msgs, raven.PrepareMessage("", "", fmt.Sprintf("message-%d", i), ""))
+	}
+	msgs = append(msgs, raven.PrepareMessage("", "", "", ""))
+	errs := h.farm.FlyBatch(h.dest, msgs)
+	if len(errs) != len(msgs) {
+		t.Fatalf("Expected %d errors, got %d", len(msgs), len(errs))
+	}
+	for i, err := range errs[:12] {
+		if err != nil {
+			t.Fatalf("Expected message %d to be sent, got: %s", i, err)
+		}
+	}
+	if errs[12] != raven.ErrNoMessage {
+		t.Fatalf("Expected ErrNoMessage for empty message, got: %v", errs[12])
+	}
+
+	expected := make(map[string][]raven.Message)
+	for _, m := range msgs[:12] {
+		box, err := h.dest.GetBox4Msg(m)
+		if err != nil {
+			t.Fatalf("GetBox4Msg failed: %s", err)
+		}
+		expected[box.GetName()] = append(expected[box.GetName()], m)
+	}
+	for _, r := range h.receiver.GetMsgReceivers() {
+		box := r.GetMsgBox()
+		h.expectInFlight(*r, len(expected[box.GetName()]))
+		for _, m := range expected[box.GetName()] {
+			got := h.receive(*r)
+			if got.Id != m.Id || got.Data != m.Data || got.SentAt.IsZero() {
+				t.Fatalf("Expected message %s, got %s", m, got)
+			}
+		}
+		h.expectEmpty(*r)
+	}
+
+	errs = h.farm.FlyBatch(raven.Destination{}, msgs[:2])
+	if errs[0] == nil || errs[1] == nil {
+		t.Fatalf("Expected errors for an invalid destination, got %v", errs)
+	}
+}
@@ -0,0 +1,122 @@
+//
+// Package ravennewrelic reports raven farms to New Relic.
+//
+//	app, _ := newrelic.NewApplication(config)
+//	farm.SetInstrumentation(ravennewrelic.New(app))
+//
+// Handlers receive the newrelic.Transaction of message and can record
+// segments on it:
+//
+//	func(m *raven.Message, txn raven.Transaction) error {
+//		nrtxn := ravennewrelic.Transaction(txn)
+//		...
+//	}
+//
+// Handlers written against newrelic.Transaction, before raven.Transaction, are
+// adapted using Handler:
+//
+//	receiver.Start(ravennewrelic.Handler(func(m *raven.Message, txn newrelic.Transaction) error {
+//		...
+//	}))
+//
+package ravennewrelic
+
+import (
+	"time"
+
+	newrelic "github.com/newrelic/go-agent"
+
+	"github.com/kukkar/raven"
+)
+
+var _ raven.Instrumentation = (*Instrumentation)(nil)
+
+//
+// Create instrumentation reporting to the supplied New Relic application.
+//
+func New(app newrelic.Application) *Instrumentation {
+	return &Instrumentation{app: app}
+}
+
+//
+// Instrumentation reporting messages as transactions, and heartbeats, sends and
+// errors as custom events.
+//
+type Instrumentation struct {
+	app newrelic.Application
+}
+
+func (this *Instrumentation) StartMessage(receiver string, m *raven.Message) raven.Transaction {
+	txn := this.app.StartTransaction(receiver, nil, nil)
+	txn.AddAttribute("msgId", m.Id)
+	txn.AddAttribute("type", m.Type)
+	return txn
+}
+
+func (this *Instrumentation) RecordHeartBeat(receiver string, hb raven.HeartBeat) {
+	this.app.RecordCustomEvent(
+		"RavenHeartBeat", map[string]interface{}{
+			"inflightcount": hb.Inflight,
+			"checkedAt":     int(time.Now().Unix()),
+			"queue":         hb.Box.GetRawName(),
+			"box":           hb.Box.GetBoxId(),
+			"deadCount":     hb.Dead,
+			"queueWaitMs":   hb.QueueWait.Milliseconds(),
+		},
+	)
+}
+
+func (this *Instrumentation) RecordSend(destination string, m raven.Message, err error) {
+	status := "sent"
+	if err != nil {
+		status = "failed"
+	}
+	this.app.RecordCustomEvent(
+		"RavenSend", map[string]interface{}{
+			"sentAt":      int(time.Now().Unix()),
+			"destination": destination,
+			"msgId":       m.Id,
+			"type":        m.Type,
+			"status":      status,
+		},
+	)
+}
+
+func (this *Instrumentation) RecordError(receiver string, err error) {
+	this.app.RecordCustomEvent(
+		"RavenError", map[string]interface{}{
+			"occurredAt": int(time.Now().Unix()),
+			"receiver":   receiver,
+			"error":      err.Error(),
+		},
+	)
+}
+
+//
+// Handler adapts a handler taking newrelic.Transaction to raven.MessageHandler.
+// Handler gets the newrelic.Transaction of message, nil if messages are not
+// reported to New Relic.
+//
+func Handler(f func(m *raven.Message, txn newrelic.Transaction) error) raven.MessageHandler {
+	return func(m *raven.Message, txn raven.Transaction) error {
+		return f(m, Transaction(txn))
+	}
+}
+
+//
+// Transaction returns the newrelic.Transaction within txn, which may combine
+// transactions of multiple instrumentations. Returns nil if there is none.
+//
+func Transaction(txn raven.Transaction) newrelic.Transaction {
+	switch t := txn.(type) {
+	case interface{ Unwrap() []raven.Transaction }:
+		for _, inner := range t.Unwrap() {
+			if nrtxn := Transaction(inner); nrtxn != nil {
+				return nrtxn
+			}
+		}
+	case newrelic.Transaction:
+		return t
+	}
+	return nil
+}
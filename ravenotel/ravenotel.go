@@ -0,0 +1,108 @@
+//
+// Package ravenotel propagates OpenTelemetry traces across ravens.
+//
+//	farm.SetTracer(ravenotel.New(nil, nil))
+//
+//	farm.GetRaven().SetContext(ctx).HandMessage(m).SetDestination(dest).Fly()
+//
+// Sending a message starts a producer span and injects W3C traceparent and
+// tracestate into headers of message. Receivers start a consumer span, as a child
+// of the producer span and linked to it, available to handlers through the context
+// of message.
+//
+package ravenotel
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/kukkar/raven"
+)
+
+//Name of the instrumentation library, reported with spans.
+const TRACER_NAME = "github.com/kukkar/raven"
+
+var _ raven.Tracer = (*Tracer)(nil)
+
+//
+// Create a tracer based on the supplied values
+// provider:    of tracers, global provider is used if nil.
+// propagator:  used to carry context in headers, W3C trace context is used if nil.
+//
+func New(provider trace.TracerProvider, propagator propagation.TextMapPropagator) *Tracer {
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	if propagator == nil {
+		propagator = propagation.TraceContext{}
+	}
+	return &Tracer{
+		tracer:     provider.Tracer(TRACER_NAME),
+		propagator: propagator,
+	}
+}
+
+//
+// Tracer implements raven.Tracer using OpenTelemetry.
+//
+type Tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+func (this *Tracer) StartSend(ctx context.Context, destination string, m *raven.Message) (context.Context, func(error)) {
+	ctx, span := this.tracer.Start(ctx, destination+" send",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "raven"),
+			attribute.String("messaging.destination.name", destination),
+			attribute.String("messaging.message.id", m.Id),
+			attribute.String("raven.message.type", m.Type),
+		),
+	)
+	//copy headers, so that the map supplied by sender is left untouched.
+	headers := make(propagation.MapCarrier, len(m.Headers)+2)
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	this.propagator.Inject(ctx, headers)
+	m.Headers = headers
+	return ctx, endSpan(span)
+}
+
+func (this *Tracer) StartProcess(ctx context.Context, box raven.MsgBox, m *raven.Message) (context.Context, func(error)) {
+	ctx = this.propagator.Extract(ctx, propagation.MapCarrier(m.Headers))
+	options := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "raven"),
+			attribute.String("messaging.destination.name", box.GetRawName()),
+			attribute.String("raven.box", box.GetName()),
+			attribute.String("messaging.message.id", m.Id),
+			attribute.String("raven.message.type", m.Type),
+			attribute.Int("raven.message.attempts", m.Attempts),
+		),
+	}
+	//link producer span, so that it is reachable even if backend breaks long traces apart.
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		options = append(options, trace.WithLinks(trace.LinkFromContext(ctx)))
+	}
+	ctx, span := this.tracer.Start(ctx, box.GetRawName()+" process", options...)
+	return ctx, endSpan(span)
+}
+
+// ends span, marking it as failed on error.
+func endSpan(span trace.Span) func(error) {
+	return func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
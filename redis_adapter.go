@@ -1,6 +1,8 @@
 package raven
 
 import (
+	"time"
+
 	"github.com/go-redis/redis"
 )
 
@@ -15,6 +17,9 @@ type RedisSimpleConfig struct {
 	Addr     string
 	Password string
 	PoolSize int
+
+	//Time to wait incase Q is empty, defaults to BLOCK_FOR_DURATION.
+	BlockFor time.Duration
 }
 
 func InitializeRedis(config RedisSimpleConfig) *RedisSimple {
@@ -25,5 +30,6 @@ func InitializeRedis(config RedisSimpleConfig) *RedisSimple {
 	})
 	redisS := new(RedisSimple)
 	redisS.Client = &RedisSimpleClient{client}
+	redisS.blockFor = config.BlockFor
 	return redisS
 }
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/go-redis/redis"
+	"github.com/google/uuid"
 )
 
 //No. of times to try incase of failure.
@@ -13,6 +14,201 @@ const MAX_TRY_LIMIT = 3
 //Time to wait incase Q is empty.
 const BLOCK_FOR_DURATION = 10 * time.Second
 
+//Interval at which receivers look for scheduled messages that are due.
+const SCHEDULE_POLL_INTERVAL = 1 * time.Second
+
+//Max no. of scheduled messages promoted in one go.
+const SCHEDULE_PROMOTE_BATCH = 100
+
+//Scheduled messages are prefixed with a unique id and a separator, so that
+//identical messages do not collapse into one within the sorted set.
+const scheduledPrefixLen = 36 + 1
+
+//
+// Moves messages due for delivery from schedule (KEYS[1]) to box (KEYS[2]).
+// ARGV[1]: current time, ARGV[2]: max messages to move, ARGV[3]: length of
+// prefix of scheduled messages.
+//
+var promoteListScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, m in ipairs(due) do
+	redis.call('ZREM', KEYS[1], m)
+	redis.call('LPUSH', KEYS[2], string.sub(m, ARGV[3] + 1))
+end
+return #due
+`)
+
+//
+// Schedules message (ARGV[2]) at ARGV[1] in schedule (KEYS[1]) and removes
+// receipt (ARGV[3]) of message being processed from processing box (KEYS[2])
+// alongwith its visibility tracking (KEYS[3], KEYS[4]), if specified.
+//
+var delayListScript = redis.NewScript(`
+if KEYS[2] then
+	redis.call('LREM', KEYS[2], 1, ARGV[3])
+	redis.call('ZREM', KEYS[3], ARGV[3])
+	redis.call('HDEL', KEYS[4], ARGV[3])
+end
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+//
+// Removes receipt (ARGV[1]) from processing box (KEYS[1]) alongwith its
+// visibility tracking (KEYS[2], KEYS[3]).
+//
+var ackReceiptScript = redis.NewScript(`
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[3], ARGV[1])
+return redis.call('LREM', KEYS[1], 1, ARGV[1])
+`)
+
+//
+// Moves receipt (ARGV[1]) from processing box (KEYS[1]) to KEYS[2], using
+// push command ARGV[2] and removes its visibility tracking (KEYS[3], KEYS[4]).
+// Nothing is moved if receipt is not found.
+//
+var moveReceiptScript = redis.NewScript(`
+redis.call('ZREM', KEYS[3], ARGV[1])
+redis.call('HDEL', KEYS[4], ARGV[1])
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 1 then
+	redis.call(ARGV[2], KEYS[2], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+//
+// Removes receipt (ARGV[1]) from processing box (KEYS[1]) and pushes entry ARGV[2],
+// holding failure of message, to head of dead box (KEYS[2]). Visibility tracking
+// (KEYS[3], KEYS[4]) is removed. Nothing is pushed if receipt is not found.
+//
+var failReceiptScript = redis.NewScript(`
+redis.call('ZREM', KEYS[3], ARGV[1])
+redis.call('HDEL', KEYS[4], ARGV[1])
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 1 then
+	redis.call('LPUSH', KEYS[2], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+//
+// Removes entries (ARGV) from dead box (KEYS[1]), searching from its tail.
+// Returns no. of entries removed.
+//
+var removeDeadListScript = redis.NewScript(`
+local removed = 0
+for i = 1, #ARGV do
+	removed = removed + redis.call('LREM', KEYS[1], -1, ARGV[i])
+end
+return removed
+`)
+
+//
+// Returns messages whose visibility timeout expired, from processing box (KEYS[1])
+// to tail of box (KEYS[4]). Deadlines are tracked in KEYS[2] and expiries in KEYS[3].
+// Messages in processing box that are not tracked yet, get a deadline of ARGV[1] (now)
+// + ARGV[2] (timeout). Returned messages are framed again using ARGV[4], so that they
+// get a new receipt and a late ack for an earlier delivery does not affect them.
+// Messages expiring ARGV[3] times are left in place for caller to move them to dead
+// box, they are listed alongwith their expiries after the no. of messages returned.
+//
+var reapListScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local live = {}
+for _, e in ipairs(redis.call('LRANGE', KEYS[1], 0, -1)) do
+	live[e] = true
+	if not redis.call('ZSCORE', KEYS[2], e) then
+		redis.call('ZADD', KEYS[2], now + tonumber(ARGV[2]), e)
+	end
+end
+local reaped = {0}
+for i, e in ipairs(redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', now)) do
+	if not live[e] then
+		redis.call('ZREM', KEYS[2], e)
+	else
+		local count = redis.call('HINCRBY', KEYS[3], e, 1)
+		if tonumber(ARGV[3]) > 0 and count >= tonumber(ARGV[3]) then
+			--still tracked, so that it is listed again if caller fails to move it.
+			table.insert(reaped, e)
+			table.insert(reaped, count)
+		else
+			redis.call('ZREM', KEYS[2], e)
+			redis.call('LREM', KEYS[1], 1, e)
+			redis.call('HDEL', KEYS[3], e)
+			local body = e
+			if string.byte(e, 1) == 0 then
+				body = string.sub(e, 38)
+			end
+			local fresh = '\0' .. string.sub(ARGV[4], 1, 28) .. string.format('%08d', i) .. body
+			redis.call('HSET', KEYS[3], fresh, count)
+			redis.call('RPUSH', KEYS[4], fresh)
+			reaped[1] = reaped[1] + 1
+		end
+	end
+end
+return reaped
+`)
+
+//
+// Moves dead entries (ARGV[i]) from dead box (KEYS[1]) to head of box (KEYS[2]),
+// as their replacements (ARGV[i+1]). Entries no longer dead are skipped.
+//
+var replayDeadListScript = redis.NewScript(`
+local moved = 0
+for i = 1, #ARGV, 2 do
+	if redis.call('LREM', KEYS[1], 1, ARGV[i]) == 1 then
+		redis.call('LPUSH', KEYS[2], ARGV[i + 1])
+		moved = moved + 1
+	end
+end
+return moved
+`)
+
+// keys tracking visibility of messages being processed by receiver.
+func trackingKeys(r MsgReceiver) []string {
+	inflight, expiries := r.msgbox.getInflightBox(), r.msgbox.getExpiriesBox()
+	return []string{inflight.GetName(), expiries.GetName()}
+}
+
+func scheduledMember(data string) string {
+	return uuid.New().String() + "|" + data
+}
+
+// score of scheduled message, in milliseconds.
+func scheduleScore(at time.Time) float64 {
+	return float64(at.UnixNano() / int64(time.Millisecond))
+}
+
+//
+// Clients capable of running lua scripts.
+//
+type scriptRunner interface {
+	Eval(script string, keys []string, args ...interface{}) *redis.Cmd
+	EvalSha(sha1 string, keys []string, args ...interface{}) *redis.Cmd
+	ScriptExists(hashes ...string) *redis.BoolSliceCmd
+	ScriptLoad(script string) *redis.StringCmd
+}
+
+//
+// Run promote script till all due messages are moved.
+//
+func promoteScheduled(client scriptRunner, script *redis.Script, keys []string, args ...interface{}) (int, error) {
+	var total int
+	now := scheduleScore(time.Now())
+	for {
+		n, err := script.Run(client, keys, append([]interface{}{now, SCHEDULE_PROMOTE_BATCH, scheduledPrefixLen}, args...)...).Int()
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < SCHEDULE_PROMOTE_BATCH {
+			return total, nil
+		}
+	}
+}
+
 var _ RedisClient = (*RedisSimpleClient)(nil)
 var _ RedisClient = (*RedisClusterClient)(nil)
 
@@ -27,6 +223,13 @@ type RedisClient interface {
 	LRange(string, int64, int64) *redis.StringSliceCmd
 	Del(keys ...string) *redis.IntCmd
 	LLen(key string) *redis.IntCmd
+	LRem(key string, count int64, value interface{}) *redis.IntCmd
+	ZAdd(key string, members ...redis.Z) *redis.IntCmd
+	Eval(script string, keys []string, args ...interface{}) *redis.Cmd
+	EvalSha(sha1 string, keys []string, args ...interface{}) *redis.Cmd
+	ScriptExists(hashes ...string) *redis.BoolSliceCmd
+	ScriptLoad(script string) *redis.StringCmd
+	Pipelined(fn func(redis.Pipeliner) error) ([]redis.Cmder, error)
 	Close() error
 }
 
@@ -82,7 +285,18 @@ func (this *RedisClusterClient) RPopRPush(popfrom string, pushto string) error {
 // A Base client to be implemented by redis and redis cluster.
 //
 type redisbase struct {
+	codecHolder
 	Client RedisClient
+
+	//Time to wait incase Q is empty.
+	blockFor time.Duration
+}
+
+func (this *redisbase) getBlockFor() time.Duration {
+	if this.blockFor <= 0 {
+		return BLOCK_FOR_DURATION
+	}
+	return this.blockFor
 }
 
 //
@@ -95,13 +309,99 @@ func (this *redisbase) Send(message Message, dest Destination) error {
 		return err
 	}
 
-	ret := this.Client.LPush(box.GetName(), message.toJson())
+	data, err := this.encodeFramed(&message)
+	if err != nil {
+		return err
+	}
+	ret := this.Client.LPush(box.GetName(), data)
 	if ret.Err() != nil {
 		return ret.Err()
 	}
 	return nil
 }
 
+//
+// Messages are grouped by their box and pushed using a pipeline, a single LPUSH
+// for each box. With redis cluster, commands are sent to nodes owning the slots
+// of their boxes. Messages of a box share outcome of its LPUSH. If pipeline fails,
+// all messages of batch are reported failed, as it is unknown which reached redis.
+//
+func (this *redisbase) SendBatch(messages []Message, dest Destination) []error {
+	errs := make([]error, len(messages))
+	//boxes in order of their first message, alongwith entries and positions of messages.
+	boxes := make([]string, 0)
+	entries := make(map[string][]interface{})
+	positions := make(map[string][]int)
+	for i := range messages {
+		box, err := dest.GetBox4Msg(messages[i])
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		data, err := this.encodeFramed(&messages[i])
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		name := box.GetName()
+		if _, ok := entries[name]; !ok {
+			boxes = append(boxes, name)
+		}
+		entries[name] = append(entries[name], data)
+		positions[name] = append(positions[name], i)
+	}
+	if len(boxes) == 0 {
+		return errs
+	}
+	cmds := make([]*redis.IntCmd, len(boxes))
+	_, err := this.Client.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, name := range boxes {
+			cmds[i] = pipe.LPush(name, entries[name]...)
+		}
+		return nil
+	})
+	for i, name := range boxes {
+		for _, pos := range positions[name] {
+			errs[pos] = cmds[i].Err()
+			if errs[pos] == nil {
+				errs[pos] = err
+			}
+		}
+	}
+	return errs
+}
+
+//
+// Message is kept in a sorted set against its box, scored by delivery time.
+//
+func (this *redisbase) SendAt(message Message, dest Destination, at time.Time) error {
+
+	box, err := dest.GetBox4Msg(message)
+	if err != nil {
+		return err
+	}
+	data, err := this.encodeFramed(&message)
+	if err != nil {
+		return err
+	}
+	scheduled := box.getScheduledBox()
+	return this.Client.ZAdd(scheduled.GetName(), redis.Z{
+		Score:  scheduleScore(at),
+		Member: scheduledMember(data),
+	}).Err()
+}
+
+//
+// Due messages are moved by a lua script, so it is safe to be called
+// concurrently from multiple processes.
+//
+func (this *redisbase) PromoteScheduled(r MsgReceiver) (int, error) {
+	scheduled := r.msgbox.getScheduledBox()
+	return promoteScheduled(this.Client, promoteListScript,
+		[]string{scheduled.GetName(), r.msgbox.GetName()},
+	)
+}
+
 func (this *redisbase) Receive(r MsgReceiver) (*Message, error) {
 
 	var message string
@@ -115,12 +415,31 @@ func (this *redisbase) Receive(r MsgReceiver) (*Message, error) {
 		return nil, err
 	}
 	var m *Message = new(Message)
-	err = m.fromJson(message)
+	if err := this.decodeFramed(message, m); err != nil {
+		if r.options.isReliable {
+			if err := this.failEntry(r, message, message); err != nil {
+				return nil, err
+			}
+		}
+		return nil, ErrUndecodable
+	}
+	if r.options.isReliable {
+		//entry is the receipt, used to locate it in processing box.
+		m.receipt = message
+		if timeout := r.options.visibilityTimeout; timeout > 0 {
+			//in case this fails, reaper starts tracking it on its next run.
+			inflight := r.msgbox.getInflightBox()
+			this.Client.ZAdd(inflight.GetName(), redis.Z{
+				Score:  scheduleScore(time.Now().Add(timeout)),
+				Member: message,
+			})
+		}
+	}
 	return m, nil
 }
 
 func (this *redisbase) receive(source MsgBox) (string, error) {
-	ret := this.Client.BRPop(BLOCK_FOR_DURATION, source.GetName())
+	ret := this.Client.BRPop(this.getBlockFor(), source.GetName())
 	err := ret.Err()
 	if err != nil && err == redis.Nil {
 		//we got an error
@@ -137,7 +456,7 @@ func (this *redisbase) receive(source MsgBox) (string, error) {
 }
 
 func (this *redisbase) receiveReliable(source MsgBox, procQ MsgBox) (string, error) {
-	ret := this.Client.BRPopLPush(source.GetName(), procQ.GetName(), BLOCK_FOR_DURATION)
+	ret := this.Client.BRPopLPush(source.GetName(), procQ.GetName(), this.getBlockFor())
 
 	err := ret.Err()
 	if err != nil && err == redis.Nil {
@@ -157,10 +476,14 @@ func (this *redisbase) MarkProcessed(m *Message, r MsgReceiver) error {
 		return nil
 	}
 
-	return failSafeExec(func() error { //@todo: use ltrim instead of rpop.
-		//to make sure no previous message remains.
-		ret := this.Client.RPop(r.procBox.GetName())
-		err := ret.Err()
+	receipt := receiptOf(m)
+	if receipt == "" {
+		return ErrInvalidReceipt
+	}
+	return failSafeExec(func() error {
+		err := ackReceiptScript.Run(this.Client,
+			append([]string{r.procBox.GetName()}, trackingKeys(r)...), receipt,
+		).Err()
 		if err != nil && err != redis.Nil {
 			return err
 		}
@@ -174,9 +497,22 @@ func (this *redisbase) MarkFailed(m *Message, r MsgReceiver) error {
 		return nil //nothing to do
 	}
 
+	if m.receipt == "" {
+		return ErrInvalidReceipt
+	}
+	data, err := this.encodeFramed(m)
+	if err != nil {
+		return err
+	}
+	return this.failEntry(r, m.receipt, data)
+}
+
+// move entry of receipt from processing box to dead box as data.
+func (this *redisbase) failEntry(r MsgReceiver, receipt string, data string) error {
 	return failSafeExec(func() error {
-		ret := this.Client.RPopLPush(r.procBox.GetName(), r.deadBox.GetName())
-		err := ret.Err()
+		err := failReceiptScript.Run(this.Client,
+			append([]string{r.procBox.GetName(), r.deadBox.GetName()}, trackingKeys(r)...), receipt, data,
+		).Err()
 		if err != nil && err != redis.Nil {
 			return err
 		}
@@ -204,7 +540,41 @@ func (this *redisbase) PreStartup(receiver MsgReceiver) error {
 		//something went wrong
 		return err
 	}
-	return nil
+	//all messages are back in box, so is their tracking.
+	return this.Client.Del(trackingKeys(receiver)...).Err()
+}
+
+//
+// Return messages whose visibility timeout expired back to box, or to
+// dead box once they expire MaxExpiries times.
+//
+func (this *redisbase) ReapExpired(r MsgReceiver) (int, error) {
+	if !r.options.isReliable || r.options.visibilityTimeout <= 0 {
+		return 0, nil
+	}
+	inflight, expiries := r.msgbox.getInflightBox(), r.msgbox.getExpiriesBox()
+	res, err := reapListScript.Run(this.Client,
+		[]string{r.procBox.GetName(), inflight.GetName(), expiries.GetName(), r.msgbox.GetName()},
+		scheduleScore(time.Now()), int64(r.options.visibilityTimeout/time.Millisecond),
+		r.options.maxExpiries, uuid.New().String(),
+	).Result()
+	if err != nil {
+		return 0, err
+	}
+	values, ok := res.([]interface{})
+	if !ok || len(values) == 0 {
+		return 0, fmt.Errorf("Unexpected reply while reaping messages: %v", res)
+	}
+	reaped, _ := values[0].(int64)
+	for i := 1; i+1 < len(values); i += 2 {
+		entry, _ := values[i].(string)
+		count, _ := values[i+1].(int64)
+		if err := this.failEntry(r, entry, this.expiredEntry(r, entry, int(count))); err != nil {
+			return int(reaped), err
+		}
+		reaped++
+	}
+	return int(reaped), nil
 }
 
 func (this *redisbase) KillReceiver(r RavenReceiver) error {
@@ -214,18 +584,43 @@ func (this *redisbase) KillReceiver(r RavenReceiver) error {
 func (this *redisbase) RequeMessage(message Message, receiver MsgReceiver) error {
 	if !receiver.options.isReliable {
 		//simply reque message
-		ret := this.Client.RPush(receiver.msgbox.GetName(), message.toJson())
+		data, err := this.encodeFramed(&message)
+		if err != nil {
+			return err
+		}
+		ret := this.Client.RPush(receiver.msgbox.GetName(), data)
 		if ret.Err() != nil {
 			return ret.Err()
 		}
 		return nil
 	}
 	//reque and remove from processing.
-	err := this.Client.RPopRPush(receiver.procBox.GetName(), receiver.msgbox.GetName())
-	if err == ErrEmptyQueue {
-		err = nil
+	if message.receipt == "" {
+		return ErrInvalidReceipt
 	}
-	return err
+	return moveReceiptScript.Run(this.Client,
+		append([]string{receiver.procBox.GetName(), receiver.msgbox.GetName()}, trackingKeys(receiver)...),
+		message.receipt, "RPUSH",
+	).Err()
+}
+
+func (this *redisbase) DelayMessage(message Message, receiver MsgReceiver, at time.Time) error {
+	data, err := this.encodeFramed(&message)
+	if err != nil {
+		return err
+	}
+	scheduled := receiver.msgbox.getScheduledBox()
+	keys := []string{scheduled.GetName()}
+	if receiver.options.isReliable {
+		if message.receipt == "" {
+			return ErrInvalidReceipt
+		}
+		keys = append(keys, receiver.procBox.GetName())
+		keys = append(keys, trackingKeys(receiver)...)
+	}
+	return delayListScript.Run(this.Client, keys,
+		scheduleScore(at), scheduledMember(data), message.receipt,
+	).Err()
 }
 
 func (this *redisbase) ShowDeadQ(receiver MsgReceiver) ([]*Message, error) {
@@ -241,7 +636,7 @@ func (this *redisbase) ShowDeadQ(receiver MsgReceiver) ([]*Message, error) {
 	msgs := make([]*Message, 0, len(data))
 	for _, v := range data {
 		m := new(Message)
-		err := m.fromJson(v)
+		err := this.decodeFramed(v, m)
 		if err != nil {
 			continue
 		}
@@ -250,11 +645,90 @@ func (this *redisbase) ShowDeadQ(receiver MsgReceiver) ([]*Message, error) {
 	return msgs, nil
 }
 
+func (this *redisbase) BrowseDeadQ(r MsgReceiver, filter DeadFilter, cursor string, limit int) (DeadPage, error) {
+	if !r.options.isReliable {
+		return newDeadPage(), nil //no deadQ
+	}
+	return this.browseDeadList(filter, cursor, limit, this.fetchDead(r))
+}
+
+// fetch upto n dead entries, oldest first, after skipping skip of them from tail.
+func (this *redisbase) fetchDead(r MsgReceiver) func(skip int, n int) ([]string, error) {
+	return func(skip int, n int) ([]string, error) {
+		entries, err := this.Client.LRange(r.deadBox.GetName(), int64(-(skip + n)), int64(-(skip + 1))).Result()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		return oldestFirst(entries), nil
+	}
+}
+
 func (this *redisbase) FlushDeadQ(receiver MsgReceiver) error {
 	res := this.Client.Del(receiver.deadBox.GetName())
 	return res.Err()
 }
 
+func (this *redisbase) ReplayDead(r MsgReceiver, filter DeadFilter, limit int) (int, error) {
+	if !r.options.isReliable {
+		return 0, nil //no deadQ
+	}
+	return this.scanDead(filter, limit, deadListPages(this.fetchDead(r)), func(entries []string, picked []deadPick) (int, error) {
+		return replayInBatches(picked, func(batch []deadPick) (int, error) {
+			args := make([]interface{}, 0, 2*len(batch))
+			for _, p := range batch {
+				fresh, err := this.encodeFramed(p.msg)
+				if err != nil {
+					return 0, err
+				}
+				args = append(args, entries[p.pos], fresh)
+			}
+			return replayDeadListScript.Run(this.Client,
+				[]string{r.deadBox.GetName(), r.msgbox.GetName()}, args...,
+			).Int()
+		})
+	})
+}
+
+func (this *redisbase) DeleteDead(r MsgReceiver, filter DeadFilter, limit int) (int, error) {
+	if !r.options.isReliable {
+		return 0, nil //no deadQ
+	}
+	return this.scanDead(filter, limit, deadListPages(this.fetchDead(r)), func(entries []string, picked []deadPick) (int, error) {
+		keys := make([]string, 0, len(picked))
+		for _, p := range picked {
+			keys = append(keys, entries[p.pos])
+		}
+		return removeInBatches(keys, func(batch []string) (int, error) {
+			args := make([]interface{}, 0, len(batch))
+			for _, k := range batch {
+				args = append(args, k)
+			}
+			return removeDeadListScript.Run(this.Client, []string{r.deadBox.GetName()}, args...).Int()
+		})
+	})
+}
+
+func (this *redisbase) ExpireDead(r MsgReceiver, retention DeadRetention) (int, error) {
+	if !r.options.isReliable {
+		return 0, nil //no deadQ
+	}
+	dead := r.deadBox.GetName()
+	return this.expireDead(retention, r.id,
+		func() (int, error) {
+			n, err := this.Client.LLen(dead).Result()
+			return int(n), err
+		},
+		listDeadEntryPages(this.fetchDead(r)),
+		func(keys []string) (int, error) {
+			args := make([]interface{}, 0, len(keys))
+			for _, k := range keys {
+				args = append(args, k)
+			}
+			return removeDeadListScript.Run(this.Client, []string{dead}, args...).Int()
+		},
+	)
+}
+
 func (this *redisbase) InFlightMessages(receiver MsgReceiver) (int, error) {
 	dat := this.Client.LLen(receiver.msgbox.GetName())
 	v, err := dat.Result()
@@ -274,7 +748,10 @@ func (this *redisbase) GetDeadQCount(r MsgReceiver) (int, error) {
 }
 
 func (this *redisbase) FlushAll(r MsgReceiver) error {
-	res := this.Client.Del(r.msgbox.GetName(), r.procBox.GetName(), r.deadBox.GetName())
+	scheduled := r.msgbox.getScheduledBox()
+	res := this.Client.Del(append([]string{
+		r.msgbox.GetName(), r.procBox.GetName(), r.deadBox.GetName(), scheduled.GetName(),
+	}, trackingKeys(r)...)...)
 	return res.Err()
 }
 
@@ -1,6 +1,8 @@
 package raven
 
 import (
+	"time"
+
 	"github.com/go-redis/redis"
 )
 
@@ -15,6 +17,9 @@ type RedisClusterConfig struct {
 	Addrs    []string
 	Password string
 	PoolSize int
+
+	//Time to wait incase Q is empty, defaults to BLOCK_FOR_DURATION.
+	BlockFor time.Duration
 }
 
 func InitializeRedisCluster(config RedisClusterConfig) *RedisCluster {
@@ -25,5 +30,6 @@ func InitializeRedisCluster(config RedisClusterConfig) *RedisCluster {
 	})
 	redisCluster := new(RedisCluster)
 	redisCluster.Client = &RedisClusterClient{client}
+	redisCluster.blockFor = config.BlockFor
 	return redisCluster
 }
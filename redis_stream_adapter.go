@@ -0,0 +1,852 @@
+package raven
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/google/uuid"
+)
+
+//Field of stream entry, that holds the encoded message.
+const STREAM_MSG_FIELD = "msg"
+
+//Pending entries of other consumers idle for this long are claimed at startup.
+const STREAM_CLAIM_IDLE = 60 * time.Second
+
+//Pending entries looked at in one go, while claiming them.
+const STREAM_PENDING_BATCH = 1000
+
+//Max entries counted for in flight messages, when redis does not report lag.
+const STREAM_LAG_SCAN = 1000
+
+//
+// Moves messages due for delivery from schedule (KEYS[1]) to stream (KEYS[2]).
+// ARGV[1]: current time, ARGV[2]: max messages to move, ARGV[3]: length of
+// prefix of scheduled messages, ARGV[4]: max length of stream, ARGV[5]: field
+// holding message.
+//
+var promoteStreamScript = redis.NewScript(`
+redis.replicate_commands()
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, m in ipairs(due) do
+	redis.call('ZREM', KEYS[1], m)
+	if tonumber(ARGV[4]) > 0 then
+		redis.call('XADD', KEYS[2], 'MAXLEN', '~', ARGV[4], '*', ARGV[5], string.sub(m, ARGV[3] + 1))
+	else
+		redis.call('XADD', KEYS[2], '*', ARGV[5], string.sub(m, ARGV[3] + 1))
+	end
+end
+return #due
+`)
+
+//
+// Moves dead entries with ids ARGV[i] from dead stream (KEYS[1]) to stream (KEYS[2]),
+// as new entries holding ARGV[i+1]. Entries no longer dead are skipped.
+// ARGV[1]: max length of stream, ARGV[2]: field holding message.
+//
+var replayDeadStreamScript = redis.NewScript(`
+redis.replicate_commands()
+local moved = 0
+for i = 3, #ARGV, 2 do
+	if redis.call('XDEL', KEYS[1], ARGV[i]) == 1 then
+		if tonumber(ARGV[1]) > 0 then
+			redis.call('XADD', KEYS[2], 'MAXLEN', '~', ARGV[1], '*', ARGV[2], ARGV[i + 1])
+		else
+			redis.call('XADD', KEYS[2], '*', ARGV[2], ARGV[i + 1])
+		end
+		moved = moved + 1
+	end
+end
+return moved
+`)
+
+//
+// Configuration to Initialize redis stream manager.
+// A single address connects to redis, multiple addresses to redis cluster.
+//
+type RedisStreamConfig struct {
+	Addrs    []string
+	Password string
+	PoolSize int
+
+	//Name of this consumer within the group, must be unique per process.
+	//Defaults to hostname, pid and a random suffix.
+	Consumer string
+
+	//Approximate cap on length of each stream, 0 means no cap.
+	MaxLen int64
+
+	//Pending entries of other consumers idle for more than this are claimed
+	//at startup, defaults to STREAM_CLAIM_IDLE.
+	ClaimIdle time.Duration
+
+	//Time to wait incase Q is empty, defaults to BLOCK_FOR_DURATION.
+	BlockFor time.Duration
+}
+
+//
+// A Raven Manager built on top of redis streams.
+//
+// Each MsgBox maps to a stream and each RavenReceiver to a consumer group on it.
+// Multiple processes can receive from the same source, each message of a box is
+// delivered to one consumer of the group. In reliable mode, pending entries list
+// of the group serves as processing box and dead messages are moved to a
+// separate stream.
+//
+type RedisStream struct {
+	codecHolder
+	Client redis.UniversalClient
+
+	consumer  string
+	maxLen    int64
+	claimIdle time.Duration
+	blockFor  time.Duration
+
+	//entries claimed at startup, served before reading new entries.
+	mutex   sync.Mutex
+	claimed map[string][]redis.XMessage
+}
+
+func InitializeRedisStream(config RedisStreamConfig) *RedisStream {
+	client := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:    config.Addrs,
+		Password: config.Password,
+		PoolSize: config.PoolSize,
+	})
+	s := new(RedisStream)
+	s.Client = client
+	s.consumer = config.Consumer
+	if s.consumer == "" {
+		host, _ := os.Hostname()
+		s.consumer = fmt.Sprintf("%s-%d-%s", host, os.Getpid(), uuid.New().String()[:8])
+	}
+	s.maxLen = config.MaxLen
+	s.claimIdle = config.ClaimIdle
+	if s.claimIdle <= 0 {
+		s.claimIdle = STREAM_CLAIM_IDLE
+	}
+	s.blockFor = config.BlockFor
+	if s.blockFor <= 0 {
+		s.blockFor = BLOCK_FOR_DURATION
+	}
+	s.claimed = make(map[string][]redis.XMessage)
+	return s
+}
+
+// Consumer groups take care of distribution, so receivers need not be singleton.
+func (this *RedisStream) allowsSharedReceivers() bool {
+	return true
+}
+
+// group name for the receiver.
+func (this *RedisStream) group(r MsgReceiver) string {
+	return r.parent.GetId()
+}
+
+func (this *RedisStream) addArgs(stream string, message Message) (*redis.XAddArgs, error) {
+	data, err := this.encode(&message)
+	if err != nil {
+		return nil, err
+	}
+	return &redis.XAddArgs{
+		Stream:       stream,
+		MaxLenApprox: this.maxLen,
+		Values:       map[string]interface{}{STREAM_MSG_FIELD: data},
+	}, nil
+}
+
+// create consumer group if it does not exists.
+func (this *RedisStream) ensureGroup(r MsgReceiver) error {
+	err := this.Client.XGroupCreateMkStream(r.msgbox.GetName(), this.group(r), "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+func (this *RedisStream) decodeEntry(x redis.XMessage) (*Message, error) {
+	data, ok := x.Values[STREAM_MSG_FIELD].(string)
+	if !ok {
+		return nil, fmt.Errorf("Stream entry [%s] does not contain a message", x.ID)
+	}
+	m := new(Message)
+	if err := this.decode(data, m); err != nil {
+		return nil, err
+	}
+	m.receipt = x.ID
+	return m, nil
+}
+
+//
+//  Implementation of Send() method exposed by raven manager.
+//
+func (this *RedisStream) Send(message Message, dest Destination) error {
+
+	box, err := dest.GetBox4Msg(message)
+	if err != nil {
+		return err
+	}
+	args, err := this.addArgs(box.GetName(), message)
+	if err != nil {
+		return err
+	}
+	return this.Client.XAdd(args).Err()
+}
+
+//
+// Messages are added to their streams using a pipeline, in a single round trip.
+// If pipeline fails, all messages of batch are reported failed.
+//
+func (this *RedisStream) SendBatch(messages []Message, dest Destination) []error {
+	errs := make([]error, len(messages))
+	cmds := make([]*redis.StringCmd, len(messages))
+	_, err := this.Client.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, m := range messages {
+			box, err := dest.GetBox4Msg(m)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			args, err := this.addArgs(box.GetName(), m)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			cmds[i] = pipe.XAdd(args)
+		}
+		return nil
+	})
+	for i, cmd := range cmds {
+		if cmd == nil {
+			continue
+		}
+		errs[i] = cmd.Err()
+		if errs[i] == nil {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+//
+// Message is kept in a sorted set against its stream, scored by delivery time.
+//
+func (this *RedisStream) SendAt(message Message, dest Destination, at time.Time) error {
+
+	box, err := dest.GetBox4Msg(message)
+	if err != nil {
+		return err
+	}
+	data, err := this.encode(&message)
+	if err != nil {
+		return err
+	}
+	scheduled := box.getScheduledBox()
+	return this.Client.ZAdd(scheduled.GetName(), redis.Z{
+		Score:  scheduleScore(at),
+		Member: scheduledMember(data),
+	}).Err()
+}
+
+//
+// Due messages are moved by a lua script, so it is safe to be called
+// concurrently from multiple processes.
+//
+func (this *RedisStream) PromoteScheduled(r MsgReceiver) (int, error) {
+	scheduled := r.msgbox.getScheduledBox()
+	return promoteScheduled(this.Client, promoteStreamScript,
+		[]string{scheduled.GetName(), r.msgbox.GetName()},
+		this.maxLen, STREAM_MSG_FIELD,
+	)
+}
+
+//
+// Create the consumer group and, for reliable receivers, claim entries left
+// pending by consumers that went away. Entries are claimed only once idle for
+// ClaimIdle, since a consumer of the same name may well be alive and handling them.
+//
+func (this *RedisStream) PreStartup(r MsgReceiver) error {
+	if err := this.ensureGroup(r); err != nil {
+		return err
+	}
+	if !r.options.isReliable {
+		return nil
+	}
+	stream := r.msgbox.GetName()
+	claimed := make([]redis.XMessage, 0)
+	err := this.scanPending(r, func(pending []redis.XPendingExt) error {
+		ids := make([]string, 0, len(pending))
+		for _, p := range pending {
+			if p.Idle >= this.claimIdle {
+				ids = append(ids, p.Id)
+			}
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		//min idle makes sure that only one process claims an entry.
+		res, err := this.Client.XClaim(&redis.XClaimArgs{
+			Stream:   stream,
+			Group:    this.group(r),
+			Consumer: this.consumer,
+			MinIdle:  this.claimIdle,
+			Messages: ids,
+		}).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		claimed = append(claimed, res...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	this.mutex.Lock()
+	this.claimed[stream] = claimed
+	this.mutex.Unlock()
+	return nil
+}
+
+//
+// Visit pending entries of group in order of their ids, a page of upto
+// STREAM_PENDING_BATCH at a time, till a page comes back short.
+//
+func (this *RedisStream) scanPending(r MsgReceiver, f func(pending []redis.XPendingExt) error) error {
+	var cursor string
+	for {
+		start, n := "-", int64(STREAM_PENDING_BATCH)
+		if cursor != "" {
+			//range is inclusive of cursor, which was visited already.
+			start, n = cursor, n+1
+		}
+		pending, err := this.Client.XPendingExt(&redis.XPendingExtArgs{
+			Stream: r.msgbox.GetName(),
+			Group:  this.group(r),
+			Start:  start,
+			End:    "+",
+			Count:  n,
+		}).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if len(pending) > 0 && pending[0].Id == cursor {
+			pending = pending[1:]
+		}
+		if len(pending) > STREAM_PENDING_BATCH {
+			pending = pending[:STREAM_PENDING_BATCH]
+		}
+		if len(pending) > 0 {
+			if err := f(pending); err != nil {
+				return err
+			}
+			cursor = pending[len(pending)-1].Id
+		}
+		if len(pending) < STREAM_PENDING_BATCH {
+			return nil
+		}
+	}
+}
+
+//
+// Pending entries idle for longer than visibility timeout are claimed by this
+// consumer and served again, or moved to dead box once delivered MaxExpiries times.
+// Entries keep their id when redelivered, so unlike list based managers a late ack
+// of an expired delivery acks the redelivery as well.
+//
+func (this *RedisStream) ReapExpired(r MsgReceiver) (int, error) {
+	if !r.options.isReliable || r.options.visibilityTimeout <= 0 {
+		return 0, nil
+	}
+	stream := r.msgbox.GetName()
+	//entries already claimed and waiting to be served.
+	waiting := make(map[string]bool)
+	this.mutex.Lock()
+	for _, x := range this.claimed[stream] {
+		waiting[x.ID] = true
+	}
+	this.mutex.Unlock()
+
+	reaped := 0
+	err := this.scanPending(r, func(pending []redis.XPendingExt) error {
+		n, err := this.reapPending(r, pending, waiting)
+		reaped += n
+		return err
+	})
+	return reaped, err
+}
+
+//
+// Claim a page of pending entries whose visibility expired, skipping the ones
+// waiting to be served. Returns no. of entries claimed.
+//
+func (this *RedisStream) reapPending(r MsgReceiver, pending []redis.XPendingExt, waiting map[string]bool) (int, error) {
+	stream := r.msgbox.GetName()
+	ids := make([]string, 0)
+	//no. of times entries to be dead lettered have expired.
+	dead := make(map[string]int)
+	for _, p := range pending {
+		if p.Idle < r.options.visibilityTimeout || waiting[p.Id] {
+			continue
+		}
+		ids = append(ids, p.Id)
+		if r.options.maxExpiries > 0 && p.RetryCount >= int64(r.options.maxExpiries) {
+			dead[p.Id] = int(p.RetryCount)
+		}
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	//min idle makes sure that only one process claims an entry.
+	claimed, err := this.Client.XClaim(&redis.XClaimArgs{
+		Stream:   stream,
+		Group:    this.group(r),
+		Consumer: this.consumer,
+		MinIdle:  r.options.visibilityTimeout,
+		Messages: ids,
+	}).Result()
+	if err != nil && err != redis.Nil {
+		return 0, err
+	}
+	retry := make([]redis.XMessage, 0, len(claimed))
+	for _, x := range claimed {
+		expiries, ok := dead[x.ID]
+		if !ok {
+			retry = append(retry, x)
+			continue
+		}
+		//entries failing to decode are moved as is.
+		values := x.Values
+		if m, err := this.decodeEntry(x); err == nil {
+			m.recordExpiry(&r, expiries)
+			if data, err := this.encode(m); err == nil {
+				values = map[string]interface{}{STREAM_MSG_FIELD: data}
+			}
+		}
+		err := this.failEntry(r, x.ID, &redis.XAddArgs{
+			Stream:       r.deadBox.GetName(),
+			MaxLenApprox: this.maxLen,
+			Values:       values,
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	this.mutex.Lock()
+	this.claimed[stream] = append(this.claimed[stream], retry...)
+	this.mutex.Unlock()
+	return len(claimed), nil
+}
+
+// pick an entry claimed at startup if any.
+func (this *RedisStream) popClaimed(stream string) (redis.XMessage, bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	entries := this.claimed[stream]
+	if len(entries) == 0 {
+		return redis.XMessage{}, false
+	}
+	this.claimed[stream] = entries[1:]
+	return entries[0], true
+}
+
+func (this *RedisStream) Receive(r MsgReceiver) (*Message, error) {
+
+	stream := r.msgbox.GetName()
+	if x, ok := this.popClaimed(stream); ok {
+		return this.receiveEntry(r, x)
+	}
+	res, err := this.Client.XReadGroup(&redis.XReadGroupArgs{
+		Group:    this.group(r),
+		Consumer: this.consumer,
+		Streams:  []string{stream, ">"},
+		Count:    1,
+		Block:    this.blockFor,
+		NoAck:    !r.options.isReliable,
+	}).Result()
+	if err == redis.Nil {
+		return nil, ErrEmptyQueue
+	}
+	if err != nil && strings.HasPrefix(err.Error(), "NOGROUP") {
+		//stream got flushed, recreate group.
+		if err := this.ensureGroup(r); err != nil {
+			return nil, err
+		}
+		return nil, ErrEmptyQueue
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(res) != 1 || len(res[0].Messages) != 1 {
+		return nil, fmt.Errorf("An unexpected error occured while fetching message from Stream: %s", stream)
+	}
+	return this.receiveEntry(r, res[0].Messages[0])
+}
+
+// decode a delivered entry, entries that cannot be decoded are moved to dead box as is.
+func (this *RedisStream) receiveEntry(r MsgReceiver, x redis.XMessage) (*Message, error) {
+	m, err := this.decodeEntry(x)
+	if err == nil {
+		return m, nil
+	}
+	if r.options.isReliable {
+		values := x.Values
+		if len(values) == 0 {
+			values = map[string]interface{}{STREAM_MSG_FIELD: ""}
+		}
+		err := this.failEntry(r, x.ID, &redis.XAddArgs{
+			Stream:       r.deadBox.GetName(),
+			MaxLenApprox: this.maxLen,
+			Values:       values,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, ErrUndecodable
+}
+
+func (this *RedisStream) MarkProcessed(m *Message, r MsgReceiver) error {
+
+	if !r.options.isReliable {
+		return nil
+	}
+	if receiptOf(m) == "" {
+		return ErrInvalidReceipt
+	}
+	return this.Client.XAck(r.msgbox.GetName(), this.group(r), m.receipt).Err()
+}
+
+func (this *RedisStream) MarkFailed(m *Message, r MsgReceiver) error {
+
+	if m == nil || (!r.options.isReliable) {
+		return nil //nothing to do
+	}
+	if m.receipt == "" {
+		return ErrInvalidReceipt
+	}
+	args, err := this.addArgs(r.deadBox.GetName(), *m)
+	if err != nil {
+		return err
+	}
+	return this.failEntry(r, m.receipt, args)
+}
+
+// add entry to dead box and ack pending entry of id, within a transaction.
+func (this *RedisStream) failEntry(r MsgReceiver, id string, args *redis.XAddArgs) error {
+	_, err := this.Client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.XAdd(args)
+		pipe.XAck(r.msgbox.GetName(), this.group(r), id)
+		return nil
+	})
+	return err
+}
+
+func (this *RedisStream) KillReceiver(r RavenReceiver) error {
+	return ErrNotImplemented
+}
+
+//
+// Requeued message is added as a new entry at the end of stream and
+// the pending entry is acked, both within a transaction.
+//
+func (this *RedisStream) RequeMessage(message Message, r MsgReceiver) error {
+	args, err := this.addArgs(r.msgbox.GetName(), message)
+	if err != nil {
+		return err
+	}
+	if !r.options.isReliable {
+		return this.Client.XAdd(args).Err()
+	}
+	if message.receipt == "" {
+		return ErrInvalidReceipt
+	}
+	_, err = this.Client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.XAdd(args)
+		pipe.XAck(r.msgbox.GetName(), this.group(r), message.receipt)
+		return nil
+	})
+	return err
+}
+
+func (this *RedisStream) DelayMessage(message Message, r MsgReceiver, at time.Time) error {
+	data, err := this.encode(&message)
+	if err != nil {
+		return err
+	}
+	scheduled := r.msgbox.getScheduledBox()
+	member := redis.Z{Score: scheduleScore(at), Member: scheduledMember(data)}
+	if !r.options.isReliable {
+		return this.Client.ZAdd(scheduled.GetName(), member).Err()
+	}
+	if message.receipt == "" {
+		return ErrInvalidReceipt
+	}
+	_, err = this.Client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(scheduled.GetName(), member)
+		pipe.XAck(r.msgbox.GetName(), this.group(r), message.receipt)
+		return nil
+	})
+	return err
+}
+
+func (this *RedisStream) ShowDeadQ(r MsgReceiver) ([]*Message, error) {
+	res, err := this.Client.XRange(r.deadBox.GetName(), "-", "+").Result()
+	if err != nil && err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*Message, 0, len(res))
+	for _, x := range res {
+		m, err := this.decodeEntry(x)
+		if err != nil {
+			continue
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+//
+// Dead box is browsed in order of stream ids, cursor is the id of last entry listed.
+//
+func (this *RedisStream) BrowseDeadQ(r MsgReceiver, filter DeadFilter, cursor string, limit int) (DeadPage, error) {
+	page := newDeadPage()
+	if !r.options.isReliable {
+		return page, nil //no deadQ
+	}
+	limit = pageLimit(limit)
+	start := "-"
+	if cursor != "" {
+		start = cursor
+	}
+	for {
+		res, err := this.Client.XRangeN(r.deadBox.GetName(), start, "+", DEAD_SCAN_BATCH).Result()
+		if err != nil && err != redis.Nil {
+			return page, err
+		}
+		for _, x := range res {
+			//range is inclusive of cursor, which was listed already.
+			if x.ID == cursor {
+				continue
+			}
+			cursor = x.ID
+			data, ok := x.Values[STREAM_MSG_FIELD].(string)
+			if !ok {
+				data = fmt.Sprint(x.Values)
+			}
+			this.collectDead(&page, data, filter)
+			if page.size() >= limit {
+				page.Next = cursor
+				return page, nil
+			}
+		}
+		if len(res) < DEAD_SCAN_BATCH {
+			return page, nil
+		}
+		start = cursor
+	}
+}
+
+//
+// Dead stream entries are removed by their ids.
+//
+func (this *RedisStream) ExpireDead(r MsgReceiver, retention DeadRetention) (int, error) {
+	if !r.options.isReliable {
+		return 0, nil //no deadQ
+	}
+	dead := r.deadBox.GetName()
+	var ids []string
+	pages := this.deadPages(r, &ids)
+	return this.expireDead(retention, r.id,
+		func() (int, error) {
+			n, err := this.Client.XLen(dead).Result()
+			return int(n), err
+		},
+		func(removed int) ([]deadEntry, error) {
+			data, err := pages(removed)
+			entries := make([]deadEntry, 0, len(data))
+			for i := range data {
+				entries = append(entries, deadEntry{key: ids[i], data: data[i]})
+			}
+			return entries, err
+		},
+		func(keys []string) (int, error) {
+			n, err := this.Client.XDel(dead, keys...).Result()
+			return int(n), err
+		},
+	)
+}
+
+func (this *RedisStream) FlushDeadQ(r MsgReceiver) error {
+	return this.Client.Del(r.deadBox.GetName()).Err()
+}
+
+func (this *RedisStream) ReplayDead(r MsgReceiver, filter DeadFilter, limit int) (int, error) {
+	if !r.options.isReliable {
+		return 0, nil //no deadQ
+	}
+	var ids []string
+	return this.scanDead(filter, limit, this.deadPages(r, &ids), func(entries []string, picked []deadPick) (int, error) {
+		return replayInBatches(picked, func(batch []deadPick) (int, error) {
+			args := make([]interface{}, 0, 2+2*len(batch))
+			args = append(args, this.maxLen, STREAM_MSG_FIELD)
+			for _, p := range batch {
+				data, err := this.encode(p.msg)
+				if err != nil {
+					return 0, err
+				}
+				args = append(args, ids[p.pos], data)
+			}
+			return replayDeadStreamScript.Run(this.Client,
+				[]string{r.deadBox.GetName(), r.msgbox.GetName()}, args...,
+			).Int()
+		})
+	})
+}
+
+//
+// Pages of dead stream for scanDead, in order of stream ids. Ids of entries of
+// the page are kept in ids. Removing entries does not affect paging, since next
+// page starts after the id of last entry of previous one.
+//
+func (this *RedisStream) deadPages(r MsgReceiver, ids *[]string) func(removed int) ([]string, error) {
+	var cursor string
+	return func(removed int) ([]string, error) {
+		start, n := "-", int64(DEAD_SCAN_BATCH)
+		if cursor != "" {
+			//range is inclusive of cursor, which was scanned already.
+			start, n = cursor, n+1
+		}
+		res, err := this.Client.XRangeN(r.deadBox.GetName(), start, "+", n).Result()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		if len(res) > 0 && res[0].ID == cursor {
+			res = res[1:]
+		}
+		if len(res) > DEAD_SCAN_BATCH {
+			res = res[:DEAD_SCAN_BATCH]
+		}
+		*ids = make([]string, len(res))
+		entries := make([]string, len(res))
+		for i, x := range res {
+			(*ids)[i] = x.ID
+			data, ok := x.Values[STREAM_MSG_FIELD].(string)
+			if !ok {
+				data = fmt.Sprint(x.Values)
+			}
+			entries[i] = data
+		}
+		if len(res) > 0 {
+			cursor = res[len(res)-1].ID
+		}
+		return entries, nil
+	}
+}
+
+func (this *RedisStream) DeleteDead(r MsgReceiver, filter DeadFilter, limit int) (int, error) {
+	if !r.options.isReliable {
+		return 0, nil //no deadQ
+	}
+	var ids []string
+	return this.scanDead(filter, limit, this.deadPages(r, &ids), func(entries []string, picked []deadPick) (int, error) {
+		keys := make([]string, 0, len(picked))
+		for _, p := range picked {
+			keys = append(keys, ids[p.pos])
+		}
+		return removeInBatches(keys, func(batch []string) (int, error) {
+			n, err := this.Client.XDel(r.deadBox.GetName(), batch...).Result()
+			return int(n), err
+		})
+	})
+}
+
+//
+// Entries not yet delivered to the consumer group. Redis < 7 does not report lag,
+// entries are then counted upto STREAM_LAG_SCAN, larger backlogs are reported as
+// STREAM_LAG_SCAN, so that it stays cheap to poll. Count is approximate in that case.
+//
+func (this *RedisStream) InFlightMessages(r MsgReceiver) (int, error) {
+	stream := r.msgbox.GetName()
+	cmd := redis.NewCmd("XINFO", "GROUPS", stream)
+	this.Client.Process(cmd)
+	res, err := cmd.Result()
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "ERR no such key") {
+			return 0, nil
+		}
+		return 0, err
+	}
+	groups, _ := res.([]interface{})
+	for _, g := range groups {
+		info := xinfoToMap(g)
+		if info["name"] != this.group(r) {
+			continue
+		}
+		//redis >= 7 reports lag directly, its valid only when entries-read is known.
+		if lag, ok := info["lag"].(int64); ok {
+			if _, known := info["entries-read"].(int64); known {
+				return int(lag), nil
+			}
+		}
+		//range is inclusive of last delivered entry.
+		lastId, _ := info["last-delivered-id"].(string)
+		entries, err := this.Client.XRangeN(stream, lastId, "+", STREAM_LAG_SCAN+1).Result()
+		if err != nil {
+			return 0, err
+		}
+		count := len(entries)
+		if count > 0 && entries[0].ID == lastId {
+			count--
+		}
+		if count > STREAM_LAG_SCAN {
+			count = STREAM_LAG_SCAN
+		}
+		return count, nil
+	}
+	//group not yet created, everything is in flight.
+	v, err := this.Client.XLen(stream).Result()
+	return int(v), err
+}
+
+// convert flat key value reply of XINFO to map.
+func xinfoToMap(v interface{}) map[string]interface{} {
+	info := make(map[string]interface{})
+	fields, _ := v.([]interface{})
+	for i := 0; i+1 < len(fields); i += 2 {
+		if k, ok := fields[i].(string); ok {
+			info[k] = fields[i+1]
+		}
+	}
+	return info
+}
+
+func (this *RedisStream) GetDeadQCount(r MsgReceiver) (int, error) {
+	v, err := this.Client.XLen(r.deadBox.GetName()).Result()
+	if err != nil {
+		return 0, err
+	}
+	return int(v), nil
+}
+
+func (this *RedisStream) FlushAll(r MsgReceiver) error {
+	scheduled := r.msgbox.getScheduledBox()
+	keys := []string{r.msgbox.GetName(), scheduled.GetName()}
+	if r.options.isReliable {
+		keys = append(keys, r.deadBox.GetName())
+	}
+	this.mutex.Lock()
+	delete(this.claimed, r.msgbox.GetName())
+	this.mutex.Unlock()
+	return this.Client.Del(keys...).Err()
+}
+
+func (this *RedisStream) Quit(r MsgReceiver) error {
+	return this.Client.Close()
+}
@@ -0,0 +1,232 @@
+package raven
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+//How often dead boxes are checked for messages exceeding retention.
+const DEAD_JANITOR_INTERVAL = time.Minute
+
+//
+// DeadRetention limits how long and how many messages are kept in a dead box.
+// Messages exceeding it are removed, oldest first, by a background janitor.
+//
+type DeadRetention struct {
+	//Messages dead for longer than this are removed, 0 means no bound.
+	//Age is taken from time of failure, or time message was sent if not known.
+	MaxAge time.Duration
+
+	//Max no. of messages kept in each dead box, 0 means no bound.
+	MaxCount int
+
+	//Removed messages are archived here, they are dropped if nil.
+	Archive DeadArchive
+
+	//How often janitor runs, DEAD_JANITOR_INTERVAL if 0.
+	Interval time.Duration
+}
+
+// check if retention limits dead boxes.
+func (this DeadRetention) enabled() bool {
+	return this.MaxAge > 0 || this.MaxCount > 0
+}
+
+func (this DeadRetention) interval() time.Duration {
+	if this.Interval <= 0 {
+		return DEAD_JANITOR_INTERVAL
+	}
+	return this.Interval
+}
+
+// time since message is dead, zero if not known.
+func (this DeadRetention) deadSince(m *Message) time.Time {
+	if m.Failure != nil && !m.Failure.FailedAt.IsZero() {
+		return m.Failure.FailedAt
+	}
+	return m.SentAt
+}
+
+// check if dead message is older than MaxAge, messages of unknown age are not.
+func (this DeadRetention) expired(m *Message, now time.Time) bool {
+	if this.MaxAge <= 0 {
+		return false
+	}
+	since := this.deadSince(m)
+	return !since.IsZero() && now.Sub(since) > this.MaxAge
+}
+
+//
+// DeadArchive keeps dead messages removed on exceeding retention.
+// Messages are removed only once they are archived successfully.
+//
+type DeadArchive interface {
+	//Archive messages removed from dead box of the given message box.
+	Archive(box string, page DeadPage) error
+}
+
+//
+// Archives dead messages to a file as JSON lines, one for each message.
+// Can be shared by receivers, lines carry the box message died in.
+//
+type FileArchive struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+//
+// A line of FileArchive, holds either the message or the raw entry that
+// could not be decoded.
+//
+type archivedEntry struct {
+	Box        string
+	ArchivedAt time.Time
+	Message    *Message `json:",omitempty"`
+	Raw        string   `json:",omitempty"`
+}
+
+//
+// Open file archive at path, messages are appended if it exists.
+//
+func NewFileArchive(path string) (*FileArchive, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open dead archive [%s]: %s", path, err.Error())
+	}
+	return &FileArchive{file: file}, nil
+}
+
+//
+// Append messages to file and sync it, so that they survive once removed.
+//
+func (this *FileArchive) Archive(box string, page DeadPage) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	now := time.Now()
+	for _, m := range page.Messages {
+		if err := enc.Encode(archivedEntry{Box: box, ArchivedAt: now, Message: m}); err != nil {
+			return err
+		}
+	}
+	for _, raw := range page.Raw {
+		if err := enc.Encode(archivedEntry{Box: box, ArchivedAt: now, Raw: raw}); err != nil {
+			return err
+		}
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if _, err := this.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return this.file.Sync()
+}
+
+func (this *FileArchive) Close() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.file.Close()
+}
+
+//
+// An entry of dead box, key identifies it for removal and data is the encoded message.
+//
+type deadEntry struct {
+	key  string
+	data string
+}
+
+// entries of a list based dead box, keyed by themselves.
+func listDeadEntries(entries []string) []deadEntry {
+	dead := make([]deadEntry, 0, len(entries))
+	for _, e := range entries {
+		dead = append(dead, deadEntry{key: e, data: unframeEntry(e)})
+	}
+	return dead
+}
+
+// pages of a list based dead box for expireDead, see deadListPages.
+func listDeadEntryPages(fetch func(skip int, n int) ([]string, error)) func(removed int) ([]deadEntry, error) {
+	next := deadListPages(fetch)
+	return func(removed int) ([]deadEntry, error) {
+		entries, err := next(removed)
+		return listDeadEntries(entries), err
+	}
+}
+
+//
+// Remove messages of a dead box exceeding retention, a page of DEAD_SCAN_BATCH at a time.
+// Messages are looked at oldest first, stopping at the first one known to be within
+// retention. Messages that can not be decoded or are of unknown age, are removed only
+// if over MaxCount and skipped otherwise, so that they do not hold back older ones.
+// count returns no. of messages in dead box, next returns the page following previous
+// one, oldest first, given the no. of entries removed from it and remove deletes
+// entries by their keys. Returns no. of messages removed.
+//
+func (this *codecHolder) expireDead(retention DeadRetention, box string, count func() (int, error),
+	next func(removed int) ([]deadEntry, error), remove func(keys []string) (int, error)) (int, error) {
+
+	if !retention.enabled() {
+		return 0, nil
+	}
+	//kept is no. of entries of previous pages left in dead box.
+	var removed, kept, n int
+	for {
+		total, err := count()
+		if err != nil {
+			return removed, err
+		}
+		entries, err := next(n)
+		if err != nil {
+			return removed, err
+		}
+		now := time.Now()
+		page := newDeadPage()
+		keys := make([]string, 0, len(entries))
+		done := len(entries) < DEAD_SCAN_BATCH
+		for i, entry := range entries {
+			m := new(Message)
+			decodeErr := this.decode(entry.data, m)
+			overCount := retention.MaxCount > 0 && total-(kept+i) > retention.MaxCount
+			if !overCount {
+				if retention.MaxAge <= 0 {
+					done = true
+					break
+				}
+				if decodeErr != nil || retention.deadSince(m).IsZero() {
+					continue
+				}
+				if !retention.expired(m, now) {
+					done = true
+					break
+				}
+			}
+			if decodeErr != nil {
+				page.Raw = append(page.Raw, entry.data)
+			} else {
+				page.Messages = append(page.Messages, m)
+			}
+			keys = append(keys, entry.key)
+		}
+		n = 0
+		if len(keys) > 0 {
+			if retention.Archive != nil {
+				if err := retention.Archive.Archive(box, page); err != nil {
+					return removed, fmt.Errorf("Could not archive dead messages: %s", err.Error())
+				}
+			}
+			n, err = remove(keys)
+			removed += n
+			if err != nil {
+				return removed, err
+			}
+		}
+		if done {
+			return removed, nil
+		}
+		kept += len(entries) - n
+	}
+}
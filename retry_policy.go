@@ -0,0 +1,88 @@
+package raven
+
+import (
+	"math/rand"
+	"time"
+)
+
+//Max no. of times a message is processed, before moving it to dead box.
+const DEFAULT_RETRY_MAX_ATTEMPTS = 10
+
+//Delay before first retry of a temporarily failed message.
+const DEFAULT_RETRY_BACKOFF = 3 * time.Second
+
+//Max delay between retries of a message.
+const DEFAULT_RETRY_MAX_DELAY = 5 * time.Minute
+
+//Fraction of delay that is randomized.
+const DEFAULT_RETRY_JITTER = 0.2
+
+//
+// RetryPolicy defines how messages failing with ErrTmpFailure are retried.
+// Delay between retries grows exponentially, starting from Backoff and capped
+// at MaxDelay. Retried messages are delayed using message box schedule, so the
+// receiver keeps on processing other messages meanwhile.
+//
+type RetryPolicy struct {
+	//Max no. of times a message is processed, before moving it to dead box.
+	//0 means retry forever, DefaultRetryPolicy uses DEFAULT_RETRY_MAX_ATTEMPTS.
+	MaxAttempts int
+
+	//Delay before first retry, doubled on every subsequent retry.
+	Backoff time.Duration
+
+	//Upper limit of delay between retries.
+	MaxDelay time.Duration
+
+	//Fraction [0-1] of the delay to randomize, so that failing messages
+	//do not retry in lockstep.
+	Jitter float64
+}
+
+//
+// Policy used when none is specified.
+//
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: DEFAULT_RETRY_MAX_ATTEMPTS,
+		Backoff:     DEFAULT_RETRY_BACKOFF,
+		MaxDelay:    DEFAULT_RETRY_MAX_DELAY,
+		Jitter:      DEFAULT_RETRY_JITTER,
+	}
+}
+
+//
+// Check if a message processed attempts times should not be retried further.
+//
+func (this RetryPolicy) exhausted(attempts int) bool {
+	return this.MaxAttempts > 0 && attempts >= this.MaxAttempts
+}
+
+//
+// Delay before retrying a message already retried, retries times.
+//
+func (this RetryPolicy) delay(retries int) time.Duration {
+	backoff := this.Backoff
+	if backoff <= 0 {
+		backoff = DEFAULT_RETRY_BACKOFF
+	}
+	maxDelay := this.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = DEFAULT_RETRY_MAX_DELAY
+	}
+	d := backoff
+	for i := 0; i < retries && d < maxDelay; i++ {
+		d *= 2
+	}
+	if d > maxDelay {
+		d = maxDelay
+	}
+	if this.Jitter > 0 {
+		jitter := this.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		d -= time.Duration(rand.Float64() * jitter * float64(d))
+	}
+	return d
+}
@@ -0,0 +1,89 @@
+package raven
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{Backoff: time.Second, MaxDelay: 10 * time.Second}
+	cases := []struct {
+		retries int
+		want    time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{3, 8 * time.Second},
+		{4, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+	for _, c := range cases {
+		if got := policy.delay(c.retries); got != c.want {
+			t.Errorf("delay(%d) = %s, want %s", c.retries, got, c.want)
+		}
+	}
+}
+
+func TestRetryPolicyDelayDefaults(t *testing.T) {
+	var policy RetryPolicy
+	if got := policy.delay(0); got != DEFAULT_RETRY_BACKOFF {
+		t.Errorf("delay(0) = %s, want %s", got, DEFAULT_RETRY_BACKOFF)
+	}
+	if got := policy.delay(100); got != DEFAULT_RETRY_MAX_DELAY {
+		t.Errorf("delay(100) = %s, want %s", got, DEFAULT_RETRY_MAX_DELAY)
+	}
+}
+
+func TestRetryPolicyJitter(t *testing.T) {
+	cases := []struct {
+		jitter float64
+		min    time.Duration
+	}{
+		{0.2, 8 * time.Second},
+		{0.5, 5 * time.Second},
+		//jitter beyond 1 is capped at 1.
+		{3, 0},
+	}
+	for _, c := range cases {
+		policy := RetryPolicy{Backoff: 10 * time.Second, MaxDelay: time.Minute, Jitter: c.jitter}
+		for i := 0; i < 1000; i++ {
+			d := policy.delay(0)
+			if d < c.min || d > 10*time.Second {
+				t.Fatalf("delay with jitter %v = %s, want within [%s, %s]", c.jitter, d, c.min, 10*time.Second)
+			}
+		}
+	}
+}
+
+func TestRetryPolicyExhausted(t *testing.T) {
+	cases := []struct {
+		maxAttempts int
+		attempts    int
+		want        bool
+	}{
+		{0, 1, false},
+		{0, 1000, false},
+		{3, 1, false},
+		{3, 2, false},
+		{3, 3, true},
+		{3, 4, true},
+		{1, 1, true},
+	}
+	for _, c := range cases {
+		policy := RetryPolicy{MaxAttempts: c.maxAttempts}
+		if got := policy.exhausted(c.attempts); got != c.want {
+			t.Errorf("exhausted(%d) with MaxAttempts %d = %v, want %v", c.attempts, c.maxAttempts, got, c.want)
+		}
+	}
+}
+
+func TestDefaultRetryPolicyIsBounded(t *testing.T) {
+	policy := DefaultRetryPolicy()
+	if policy.exhausted(DEFAULT_RETRY_MAX_ATTEMPTS - 1) {
+		t.Errorf("default policy exhausted before %d attempts", DEFAULT_RETRY_MAX_ATTEMPTS)
+	}
+	if !policy.exhausted(DEFAULT_RETRY_MAX_ATTEMPTS) {
+		t.Errorf("default policy not exhausted after %d attempts", DEFAULT_RETRY_MAX_ATTEMPTS)
+	}
+}
@@ -0,0 +1,63 @@
+package raven
+
+import (
+	"sync"
+)
+
+//
+// Counts of messages of a type, handled by a receiver.
+//
+type TypeStats struct {
+	Received  int64
+	Processed int64
+	Retried   int64
+	Failed    int64
+	//Messages for which no handler was found, included in Failed as well.
+	Unknown int64
+}
+
+//
+// Per type counters of a receiver, shared by its message receivers.
+//
+type typeStats struct {
+	mutex sync.Mutex
+	types map[string]*TypeStats
+}
+
+func newTypeStats() *typeStats {
+	return &typeStats{types: make(map[string]*TypeStats)}
+}
+
+// record outcome of processing a message.
+func (this *typeStats) record(msgType string, execerr error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	s, ok := this.types[msgType]
+	if !ok {
+		s = new(TypeStats)
+		this.types[msgType] = s
+	}
+	s.Received++
+	switch execerr {
+	case nil:
+		s.Processed++
+	case ErrTmpFailure:
+		s.Retried++
+	case ErrUnknownType:
+		s.Unknown++
+		s.Failed++
+	default:
+		s.Failed++
+	}
+}
+
+// copy of counters.
+func (this *typeStats) snapshot() map[string]TypeStats {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	data := make(map[string]TypeStats, len(this.types))
+	for k, v := range this.types {
+		data[k] = *v
+	}
+	return data
+}
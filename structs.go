@@ -3,8 +3,19 @@
 //
 package raven
 
-import newrelic "github.com/newrelic/go-agent"
+import "context"
 
-type MessageHandler func(m *Message, txn newrelic.Transaction) error
+type MessageHandler func(m *Message, txn Transaction) error
+
+type ContextHandler func(ctx context.Context, m *Message) error
 
 type ShardHandler func(Message, int) (string, error)
+
+//
+// Adapt a ContextHandler to a MessageHandler, handler gets the context of message.
+//
+func AdaptContextHandler(f ContextHandler) MessageHandler {
+	return func(m *Message, txn Transaction) error {
+		return f(m.Context(), m)
+	}
+}
@@ -0,0 +1,19 @@
+package raven
+
+import (
+	"context"
+)
+
+//
+// Tracer propagates traces across ravens, opt-in by attaching one to farm.
+// See package ravenotel for an OpenTelemetry implementation.
+//
+type Tracer interface {
+	//Start span around sending message to destination and inject its context
+	//into headers of message. Returned func ends the span.
+	StartSend(ctx context.Context, destination string, m *Message) (context.Context, func(error))
+
+	//Extract context injected by producer from headers of message and start span
+	//around processing it. Returned func ends the span.
+	StartProcess(ctx context.Context, box MsgBox, m *Message) (context.Context, func(error))
+}
@@ -26,7 +26,7 @@ func failSafeExec(f func() error, maxtry int) error {
 			success = true
 			break
 		}
-		current += current
+		current++
 	}
 	if current == maxtry && !success {
 		//its a failure.
@@ -0,0 +1,86 @@
+package raven
+
+import (
+	"time"
+)
+
+//Interval at which receivers look for messages whose visibility timeout expired.
+const VISIBILITY_REAP_INTERVAL = 5 * time.Second
+
+//
+// Tracks visibility deadline of messages being processed, for managers
+// keeping boxes within process. Deliveries are tracked against their receipt.
+//
+// visibilityTracker is not safe for concurrent use, caller has to synchronize.
+//
+type visibilityTracker struct {
+	//processing box name -> receipt -> delivery.
+	boxes map[string]map[string]*trackedDelivery
+}
+
+type trackedDelivery struct {
+	//zero while message is waiting in box.
+	deadline time.Time
+	expiries int
+}
+
+func (this *visibilityTracker) box(name string) map[string]*trackedDelivery {
+	if this.boxes == nil {
+		this.boxes = make(map[string]map[string]*trackedDelivery)
+	}
+	box, ok := this.boxes[name]
+	if !ok {
+		box = make(map[string]*trackedDelivery)
+		this.boxes[name] = box
+	}
+	return box
+}
+
+// start tracking a delivery, expiries of an earlier delivery are retained.
+func (this *visibilityTracker) track(name string, receipt string, deadline time.Time) {
+	box := this.box(name)
+	if d, ok := box[receipt]; ok {
+		d.deadline = deadline
+		return
+	}
+	box[receipt] = &trackedDelivery{deadline: deadline}
+}
+
+func (this *visibilityTracker) untrack(name string, receipt string) {
+	delete(this.box(name), receipt)
+}
+
+func (this *visibilityTracker) reset(name string) {
+	delete(this.boxes, name)
+}
+
+//
+// Get the receipts among live ones whose deadline passed, alongwith the no. of
+// times they have expired, including this one. Expired deliveries are untracked
+// and live ones not being tracked yet get a deadline of timeout from now.
+//
+func (this *visibilityTracker) reap(name string, live []string, timeout time.Duration) map[string]int {
+	box := this.box(name)
+	now := time.Now()
+	expired := make(map[string]int)
+	for _, receipt := range live {
+		d, ok := box[receipt]
+		if !ok || d.deadline.IsZero() {
+			this.track(name, receipt, now.Add(timeout))
+			continue
+		}
+		if d.deadline.After(now) {
+			continue
+		}
+		expired[receipt] = d.expiries + 1
+		delete(box, receipt)
+	}
+	return expired
+}
+
+//
+// Carry expiries over to the delivery returned to box, tracked once it is received.
+//
+func (this *visibilityTracker) carry(name string, receipt string, expiries int) {
+	this.box(name)[receipt] = &trackedDelivery{expiries: expiries}
+}